@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/errm/promenade/exporter/exposition"
+	"github.com/errm/promenade/exporter/multiprocess"
+)
+
+type inspectCmd struct {
+	Path   string `arg:"positional,required" help:"A .db file, or a directory of them"`
+	Format string `arg:"--format" help:"Output format: table or json" default:"table"`
+}
+
+type validateCmd struct {
+	Dir string `arg:"positional,required" help:"Directory of .db files to check"`
+}
+
+type renderCmd struct {
+	Dir         string `arg:"positional,required" help:"Directory of .db files to render"`
+	OpenMetrics bool   `arg:"--openmetrics" help:"Render OpenMetrics instead of the text format"`
+}
+
+// runInspect prints every raw entry, returning the exit status
+func runInspect(cmd *inspectCmd) int {
+	if err := multiprocess.Inspect(os.Stdout, cmd.Path, cmd.Format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runValidate reports on every file, returning a non-zero exit status if any is invalid
+func runValidate(cmd *validateCmd) int {
+	valid, err := multiprocess.Validate(os.Stdout, cmd.Dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !valid {
+		return 1
+	}
+	return 0
+}
+
+// runRender prints the exposition text the server would serve for a
+// directory. It never compacts or deletes files, so it is safe to run against
+// a live directory.
+func runRender(cmd *renderCmd) int {
+	opts, err := multiprocessOptions(true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	collector := multiprocess.NewMultiCollector(nil,
+		multiprocess.Collectors(multiprocess.NewCollector(cmd.Dir, opts...)),
+		multiprocess.WithGlobalSeriesLimit(cfg.GlobalSeriesLimit),
+	)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+
+	families, err := reg.Gather()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	format := expfmt.NewFormat(expfmt.TypeTextPlain)
+	if cmd.OpenMetrics || cfg.ForceOpenMetrics {
+		format = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	}
+	if err := exposition.Encode(os.Stdout, families, format, collector.Units()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/errm/promenade/exporter/multiprocess/writer"
+)
+
+func TestRunRender_NeverDeletes(t *testing.T) {
+	dir := t.TempDir()
+	file, err := writer.Create(dir, "counter", "", "process_id_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Set(writer.Key{Family: "jobs", Metric: "jobs"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(file.Path(), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's environment, where the file's process has exited and the
+	// file is past --file-delete-after
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = args{
+		Dialect:            "auto",
+		ProcDir:            t.TempDir(),
+		ConflictPolicy:     "newest",
+		SharedPIDNamespace: true,
+		FileTTL:            time.Hour,
+		FileDeleteAfter:    2 * time.Hour,
+	}
+
+	if status := runRender(&renderCmd{Dir: dir}); status != 0 {
+		t.Fatalf("expected render to succeed, got status %d", status)
+	}
+	if _, err := os.Stat(file.Path()); err != nil {
+		t.Errorf("expected render to leave the expired file alone: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"go.yaml.in/yaml/v2"
+
+	"github.com/errm/promenade/exporter/multiprocess"
+)
+
+// fileConfig is the format of the file passed with --config-file
+type fileConfig struct {
+	MetricRelabelConfigs []multiprocess.RelabelConfig     `yaml:"metric_relabel_configs"`
+	PIDLabelRules        []multiprocess.PIDLabelRule      `yaml:"pid_label_rules"`
+	AggregationOverrides []multiprocess.AggregationConfig `yaml:"aggregation_overrides"`
+}
+
+// loadConfig reads the config file at path. An empty path is an empty config.
+func loadConfig(path string) (fileConfig, error) {
+	var config fileConfig
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("could not read config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// defaultMultiprocessDir is read when no --multiprocess-dir is given
+const defaultMultiprocessDir = "/app/tmp/promenade"
+
+// multiprocessDir is a directory to read, with the labels to add to its metrics
+type multiprocessDir struct {
+	path   string
+	labels prometheus.Labels
+}
+
+// multiprocessDirs parses each --multiprocess-dir as a path, or a glob of
+// paths, optionally followed by :name=value labels. Globs are left for
+// expandDirs, so directories created after the exporter starts are read.
+func multiprocessDirs(specs []string) ([]multiprocessDir, error) {
+	if len(specs) == 0 {
+		specs = []string{defaultMultiprocessDir}
+	}
+
+	var dirs []multiprocessDir
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		path := filepath.Clean(parts[0])
+		labels := make(prometheus.Labels)
+		for _, label := range parts[1:] {
+			name, value, ok := strings.Cut(label, "=")
+			if !ok || !model.LabelName(name).IsValidLegacy() {
+				return nil, fmt.Errorf("invalid label %q in multiprocess dir %q, expected name=value", label, spec)
+			}
+			labels[name] = value
+		}
+		if isGlob(path) {
+			if _, err := filepath.Match(path, ""); err != nil {
+				return nil, fmt.Errorf("invalid multiprocess dir glob %q: %w", path, err)
+			}
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("multiprocess dir %s given more than once", path)
+		}
+		seen[path] = true
+		dirs = append(dirs, multiprocessDir{path: path, labels: labels})
+	}
+	return dirs, nil
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// expandDirs returns the directories that dirs' globs match now. A glob that
+// matches nothing contributes nothing, and a directory matched more than
+// once is read with the labels of the first.
+func expandDirs(dirs []multiprocessDir) []multiprocessDir {
+	var expanded []multiprocessDir
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		paths := []string{dir.path}
+		if isGlob(dir.path) {
+			paths = matchDirs(dir.path)
+		}
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			expanded = append(expanded, multiprocessDir{path: path, labels: dir.labels})
+		}
+	}
+	return expanded
+}
+
+// matchDirs returns the directories matching pattern
+func matchDirs(pattern string) []string {
+	matches, _ := filepath.Glob(pattern)
+	var paths []string
+	for _, match := range matches {
+		if stat, err := os.Stat(match); err == nil && stat.IsDir() {
+			paths = append(paths, filepath.Clean(match))
+		}
+	}
+	return paths
+}
+
+// dirCollectors builds a collector for each multiprocess directory the first
+// time it is found, and serves those found now, so globs pick up directories
+// created after the exporter starts
+type dirCollectors struct {
+	dirs  []multiprocessDir
+	build func(dir multiprocessDir) (prometheus.Collector, error)
+
+	mu     sync.Mutex
+	built  map[string]prometheus.Collector
+	failed map[string]bool
+}
+
+func newDirCollectors(dirs []multiprocessDir, build func(dir multiprocessDir) (prometheus.Collector, error)) *dirCollectors {
+	return &dirCollectors{
+		dirs:   dirs,
+		build:  build,
+		built:  make(map[string]prometheus.Collector),
+		failed: make(map[string]bool),
+	}
+}
+
+// collectors implements multiprocess.CollectorSource. A directory whose
+// collector can't be built is logged once and tried again on every collect.
+// The collectors of directories that globs no longer match are closed.
+func (d *dirCollectors) collectors() []prometheus.Collector {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var collectors []prometheus.Collector
+	found := make(map[string]bool)
+	for _, dir := range expandDirs(d.dirs) {
+		found[dir.path] = true
+		collector, ok := d.built[dir.path]
+		if !ok {
+			var err error
+			collector, err = d.build(dir)
+			if err != nil {
+				if !d.failed[dir.path] {
+					log.Printf("Not reading multiprocess dir %s: %v", dir.path, err)
+					d.failed[dir.path] = true
+				}
+				continue
+			}
+			d.built[dir.path] = collector
+		}
+		collectors = append(collectors, collector)
+	}
+
+	for path, collector := range d.built {
+		if found[path] {
+			continue
+		}
+		delete(d.built, path)
+		if closer, ok := collector.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Closing multiprocess dir %s: %v", path, err)
+			}
+		}
+	}
+	for path := range d.failed {
+		if !found[path] {
+			delete(d.failed, path)
+		}
+	}
+	return collectors
+}
+
+// Close closes the collectors that need it, like snapshot collectors
+func (d *dirCollectors) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errs []error
+	for _, path := range slices.Sorted(maps.Keys(d.built)) {
+		if closer, ok := d.built[path].(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compactionFiles names the compaction file of each directory. With a single
+// directory the file is used as is; otherwise each needs its own, so the
+// directory's name is added to it.
+type compactionFiles struct {
+	file   string
+	perDir bool
+	used   map[string]string
+}
+
+func newCompactionFiles(file string, dirs []multiprocessDir) *compactionFiles {
+	return &compactionFiles{
+		file:   file,
+		perDir: len(dirs) > 1 || isGlob(dirs[0].path),
+		used:   make(map[string]string),
+	}
+}
+
+// forDir returns the compaction file for dir, which must not be one another
+// directory already uses
+func (c *compactionFiles) forDir(dir multiprocessDir) (string, error) {
+	file := c.file
+	if c.perDir {
+		ext := filepath.Ext(file)
+		file = strings.TrimSuffix(file, ext) + "-" + filepath.Base(dir.path) + ext
+	}
+	if other, ok := c.used[file]; ok && other != dir.path {
+		return "", fmt.Errorf("multiprocess dirs %s and %s need different names to be compacted", other, dir.path)
+	}
+	c.used[file] = dir.path
+	return file, nil
+}
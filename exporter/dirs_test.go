@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMultiprocessDirs(t *testing.T) {
+	dirs, err := multiprocessDirs([]string{"/app/tmp/web:component=web", "/app/tmp/workers/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 || dirs[0].path != "/app/tmp/web" || dirs[0].labels["component"] != "web" || dirs[1].path != "/app/tmp/workers/*" {
+		t.Errorf("expected the path and the glob as given, got %v", dirs)
+	}
+
+	for _, specs := range [][]string{
+		{"/app/tmp/web:component"},
+		{"/app/tmp/[web"},
+		{"/app/tmp/web", "/app/tmp/web/"},
+	} {
+		if _, err := multiprocessDirs(specs); err == nil {
+			t.Errorf("expected %v to be invalid", specs)
+		}
+	}
+}
+
+func TestDirCollectors(t *testing.T) {
+	root := t.TempDir()
+	dirs, err := multiprocessDirs([]string{filepath.Join(root, "web"), filepath.Join(root, "*") + ":glob=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var built []multiprocessDir
+	closed := make(map[string]bool)
+	collectors := newDirCollectors(dirs, func(dir multiprocessDir) (prometheus.Collector, error) {
+		built = append(built, dir)
+		return &closingCollector{
+			Collector: prometheus.NewGauge(prometheus.GaugeOpts{Name: "dir"}),
+			close:     func() { closed[dir.path] = true },
+		}, nil
+	})
+
+	// A glob matching nothing yet serves nothing rather than failing, while
+	// a path is read whether or not it exists
+	if got := collectors.collectors(); len(got) != 1 {
+		t.Errorf("expected only web's collector before the dirs exist, got %d", len(got))
+	}
+
+	// The glob picks up directories once they exist, and each is built once.
+	// It matches web too, which keeps the labels it was given first.
+	for _, name := range []string{"web", "karafka"} {
+		if err := os.Mkdir(filepath.Join(root, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		if got := collectors.collectors(); len(got) != 2 {
+			t.Errorf("expected a collector per dir, got %d", len(got))
+		}
+	}
+	if len(built) != 2 || built[0].path != filepath.Join(root, "web") || len(built[0].labels) != 0 || built[1].labels["glob"] != "true" {
+		t.Errorf("expected web without labels and karafka from the glob, got %v", built)
+	}
+
+	// A directory the glob no longer matches has its collector closed
+	if err := os.Remove(filepath.Join(root, "karafka")); err != nil {
+		t.Fatal(err)
+	}
+	if got := collectors.collectors(); len(got) != 1 {
+		t.Errorf("expected only web's collector once karafka is removed, got %d", len(got))
+	}
+	if !closed[filepath.Join(root, "karafka")] || closed[filepath.Join(root, "web")] {
+		t.Errorf("expected only karafka's collector to be closed, got %v", closed)
+	}
+}
+
+type closingCollector struct {
+	prometheus.Collector
+	close func()
+}
+
+func (c *closingCollector) Close() error {
+	c.close()
+	return nil
+}
+
+func TestCompactionFiles(t *testing.T) {
+	single := newCompactionFiles("/data/aggregate.json", []multiprocessDir{{path: "/app/tmp/web"}})
+	if file, err := single.forDir(multiprocessDir{path: "/app/tmp/web"}); err != nil || file != "/data/aggregate.json" {
+		t.Errorf("expected the file as given for a single dir, got %s, %v", file, err)
+	}
+
+	// A glob may match any number of dirs, so each gets its own file
+	glob := newCompactionFiles("/data/aggregate.json", []multiprocessDir{{path: "/app/*/promenade"}, {path: "/app/tmp/web"}})
+	if file, err := glob.forDir(multiprocessDir{path: "/app/karafka/promenade"}); err != nil || file != "/data/aggregate-promenade.json" {
+		t.Errorf("expected the dir's name in the file, got %s, %v", file, err)
+	}
+	if _, err := glob.forDir(multiprocessDir{path: "/app/web/promenade"}); err == nil {
+		t.Error("expected dirs with the same name to need different files")
+	}
+	if file, err := glob.forDir(multiprocessDir{path: "/app/tmp/web"}); err != nil || file != "/data/aggregate-web.json" {
+		t.Errorf("expected the dir's name in the file, got %s, %v", file, err)
+	}
+}
@@ -0,0 +1,140 @@
+// Package exposition serves gathered metrics in the text format, or in
+// OpenMetrics to scrapers that ask for it.
+package exposition
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// baseUnits are the units OpenMetrics recommends metrics are exposed in. A
+// family whose name ends with one of them is served with it as its unit.
+var baseUnits = []string{"seconds", "bytes", "joules", "grams", "meters", "ratio", "volts", "amperes", "celsius"}
+
+// UnitSource knows the units of some of the families being served, e.g. from
+// metadata declared where they are defined, by the name they are served under.
+type UnitSource interface {
+	Units() map[string]string
+}
+
+// Options configures Handler
+type Options struct {
+	// ForceOpenMetrics serves OpenMetrics whatever the scraper accepts
+	ForceOpenMetrics bool
+	// Units declares units for families whose names don't end with a base unit
+	Units UnitSource
+}
+
+// Handler serves the metrics gathered by gatherer, in the format negotiated
+// from the Accept header. In OpenMetrics, families are served with their unit
+// where it ends their name, as OpenMetrics requires; promhttp doesn't encode
+// units, which is why it isn't used. The response varies with the Accept and
+// Accept-Encoding headers, and says so for caches in front of the exporter.
+func Handler(gatherer prometheus.Gatherer, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred while gathering metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if opts.ForceOpenMetrics {
+			format = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+		}
+		var units map[string]string
+		if opts.Units != nil {
+			units = opts.Units.Units()
+		}
+
+		if !opts.ForceOpenMetrics {
+			w.Header().Add("Vary", "Accept")
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Set("Content-Type", string(format))
+		var out io.Writer = w
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		if err := Encode(out, families, format, units); err != nil {
+			log.Printf("Error encoding metrics: %v", err)
+		}
+	})
+}
+
+// Encode writes families to w in format. For OpenMetrics, they are prepared
+// as Handler prepares them, with units from declared.
+func Encode(w io.Writer, families []*dto.MetricFamily, format expfmt.Format, declared map[string]string) error {
+	if format.FormatType() == expfmt.TypeOpenMetrics {
+		for _, family := range families {
+			toOpenMetrics(family, declared[family.GetName()])
+		}
+	}
+	enc := expfmt.NewEncoder(w, format, expfmt.WithUnit())
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return fmt.Errorf("encoding %s: %w", family.GetName(), err)
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// toOpenMetrics prepares family to be served as OpenMetrics, with the unit
+// declared for it if any. Counters without _total are left for the encoder to
+// serve as unknown, under the same name as in the text format, so series
+// don't change with the Accept header.
+func toOpenMetrics(family *dto.MetricFamily, declared string) {
+	if unit := familyUnit(family.GetName(), family.GetType(), declared); unit != "" {
+		family.Unit = &unit
+	}
+}
+
+// familyUnit returns the unit to serve a family with: the declared one, or
+// failing that a base unit, if it ends the name. Otherwise the encoder would
+// append the unit to the name, and the metric would be renamed.
+func familyUnit(name string, typ dto.MetricType, declared string) string {
+	if typ == dto.MetricType_COUNTER {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	if declared != "" && strings.HasSuffix(name, "_"+declared) {
+		return declared
+	}
+	for _, unit := range baseUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
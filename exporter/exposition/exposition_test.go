@@ -0,0 +1,196 @@
+package exposition
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/errm/promenade/exporter/multiprocess"
+	"github.com/errm/promenade/exporter/multiprocess/writer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const openMetricsAccept = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5"
+
+func scrape(t *testing.T, handlerOpts Options, reg *prometheus.Registry, accept string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	Handler(reg, handlerOpts).ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Content-Type"), rec.Body.String()
+}
+
+func TestHandler_Formats(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(multiprocess.NewCollector(filepath.Join("..", "multiprocess", "test_fixtures", "counter")))
+
+	text := `# HELP widgets_created_total Multiprocess metric
+# TYPE widgets_created_total counter
+widgets_created_total 30
+widgets_created_total{type="guinness"} 250
+widgets_created_total{type="murphys"} 61
+`
+	openMetrics := `# HELP widgets_created Multiprocess metric
+# TYPE widgets_created counter
+widgets_created_total 30.0
+widgets_created_total{type="guinness"} 250.0
+widgets_created_total{type="murphys"} 61.0
+# EOF
+`
+	tests := []struct {
+		name        string
+		accept      string
+		force       bool
+		contentType string
+		expected    string
+	}{
+		{"default", "", false, "text/plain", text},
+		{"text", "text/plain;version=0.0.4", false, "text/plain", text},
+		{"negotiated", openMetricsAccept, false, "application/openmetrics-text", openMetrics},
+		{"forced", "", true, "application/openmetrics-text", openMetrics},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, body := scrape(t, Options{ForceOpenMetrics: tt.force}, reg, tt.accept)
+			if !strings.HasPrefix(contentType, tt.contentType) {
+				t.Errorf("expected content type %s, got %s", tt.contentType, contentType)
+			}
+			if body != tt.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestHandler_Vary(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	for _, tt := range []struct {
+		name     string
+		force    bool
+		expected []string
+	}{
+		{"negotiated", false, []string{"Accept", "Accept-Encoding"}},
+		{"forced", true, []string{"Accept-Encoding"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler(reg, Options{ForceOpenMetrics: tt.force}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			if vary := rec.Header().Values("Vary"); !slices.Equal(vary, tt.expected) {
+				t.Errorf("expected Vary %v, got %v", tt.expected, vary)
+			}
+		})
+	}
+}
+
+func TestHandler_OpenMetricsNames(t *testing.T) {
+	dir := t.TempDir()
+	counters, err := writer.Create(dir, "counter", "", "process_id_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer counters.Close()
+	gauges, err := writer.Create(dir, "gauge", "max", "process_id_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gauges.Close()
+	for _, set := range []struct {
+		file  *writer.File
+		name  string
+		value float64
+	}{
+		{counters, "jobs", 3},
+		{counters, "uploaded_bytes_total", 1024},
+		{gauges, "queue_wait_milliseconds", 12},
+		{gauges, "build_info", 1},
+	} {
+		if err := set.file.Set(writer.Key{Family: set.name, Metric: set.name}, set.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata := `{"queue_wait_milliseconds": {"type": "gauge", "help": "Time spent queued.", "unit": "milliseconds"}, "build_info": {"unit": "seconds"}}`
+	if err := os.WriteFile(filepath.Join(dir, "promenade_metadata.json"), []byte(metadata), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := multiprocess.NewCollector(dir)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+
+	// Counters are served under the same names as in the text format, those
+	// without _total as unknown, and units are served when they end the name
+	_, body := scrape(t, Options{Units: collector}, reg, openMetricsAccept)
+	expected := `# HELP build_info Multiprocess metric
+# TYPE build_info gauge
+build_info 1.0
+# HELP jobs Multiprocess metric
+# TYPE jobs unknown
+jobs 3.0
+# HELP queue_wait_milliseconds Time spent queued.
+# TYPE queue_wait_milliseconds gauge
+# UNIT queue_wait_milliseconds milliseconds
+queue_wait_milliseconds 12.0
+# HELP uploaded_bytes Multiprocess metric
+# TYPE uploaded_bytes counter
+# UNIT uploaded_bytes bytes
+uploaded_bytes_total 1024.0
+# EOF
+`
+	if body != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, body)
+	}
+
+	// The text format serves the same series
+	_, body = scrape(t, Options{Units: collector}, reg, "")
+	for _, sample := range []string{"\njobs 3\n", "\nuploaded_bytes_total 1024\n"} {
+		if !strings.Contains(body, sample) {
+			t.Errorf("expected the text format to serve %q:\n%s", strings.TrimSpace(sample), body)
+		}
+	}
+	if strings.Contains(body, "UNIT") {
+		t.Errorf("expected no units in the text format:\n%s", body)
+	}
+}
+
+func TestHandler_Gzip(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(multiprocess.NewCollector(filepath.Join("..", "multiprocess", "test_fixtures", "counter")))
+	_, plain := scrape(t, Options{}, reg, "")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	rec := httptest.NewRecorder()
+	Handler(reg, Options{}).ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzipped response, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain {
+		t.Errorf("expected the same metrics compressed, got:\n%s", body)
+	}
+
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rec = httptest.NewRecorder()
+	Handler(reg, Options{}).ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected no compression when gzip is refused")
+	}
+}
@@ -31,6 +31,16 @@ Promenade.gauge :water_temperature_celsius do
   multiprocess_mode :all
 end
 
+Promenade.gauge :thermostat_setpoint_celsius do
+  doc "records thermostat setpoint"
+  multiprocess_mode :mostrecent
+end
+
+Promenade.gauge :boiler_temperature_celsius do
+  doc "records boiler temprature"
+  multiprocess_mode :livemostrecent
+end
+
 Process.fork do
   Promenade.metric(:room_temperature_celsius).set({ room: "lounge" }, 22.3)
   Promenade.metric(:outside_temperature_celsius).set({ sensor: "garden" }, 11.1)
@@ -38,6 +48,8 @@ Process.fork do
   Promenade.metric(:oven_temperature_celsius).set({ oven: "grill" }, 22)
   Promenade.metric(:greenhouse_temperature_celsius).set({ greenhouse: "inside" }, 27.1)
   Promenade.metric(:water_temperature_celsius).set({}, 32.1)
+  Promenade.metric(:thermostat_setpoint_celsius).set({ zone: "upstairs" }, 19.5)
+  Promenade.metric(:boiler_temperature_celsius).set({}, 60)
 end
 
 Process.fork do
@@ -45,6 +57,7 @@ Process.fork do
   Promenade.metric(:room_temperature_celsius).set({ room: "broom_cupboard" }, 15.37)
   Promenade.metric(:oven_temperature_celsius).set({ oven: "top" }, 150.2)
   Promenade.metric(:greenhouse_temperature_celsius).set({ greenhouse: "inside" }, 27.2)
+  Promenade.metric(:thermostat_setpoint_celsius).set({ zone: "upstairs" }, 21)
 end
 
 Process.fork do
@@ -52,6 +65,8 @@ Process.fork do
   Promenade.metric(:outside_temperature_celsius).set({ sensor: "garden" }, 10.9)
   Promenade.metric(:oven_temperature_celsius).set({ oven: "top" }, 155.2)
   Promenade.metric(:water_temperature_celsius).set({}, 33.1)
+  Promenade.metric(:thermostat_setpoint_celsius).set({ zone: "upstairs" }, 20)
+  Promenade.metric(:boiler_temperature_celsius).set({}, 65)
 end
 
 Process.waitall
@@ -0,0 +1,72 @@
+import os
+import shutil
+
+# prometheus_client reads the directory when it is imported
+os.environ["PROMETHEUS_MULTIPROC_DIR"] = "multiprocess/test_fixtures/python"
+shutil.rmtree(os.environ["PROMETHEUS_MULTIPROC_DIR"], ignore_errors=True)
+os.makedirs(os.environ["PROMETHEUS_MULTIPROC_DIR"])
+
+
+
+
+class Metrics:
+    """Defined in each worker, as gunicorn does without preload_app, so the
+    parent process writes no files of its own."""
+
+    def __init__(self):
+        self.http_requests = Counter("http_requests", "HTTP requests handled", ["method"])
+        self.inprogress_requests = Gauge("inprogress_requests", "Requests in progress", multiprocess_mode="livesum")
+        self.queue_depth = Gauge("queue_depth", "Deepest queue seen", ["queue"], multiprocess_mode="max")
+        self.free_memory_bytes = Gauge("free_memory_bytes", "Free memory", multiprocess_mode="livemin")
+        self.jobs_processed = Gauge("jobs_processed", "Jobs processed", multiprocess_mode="sum")
+        self.cache_entries = Gauge("cache_entries", "Entries in the cache", multiprocess_mode="all")
+        self.deployed_version = Gauge("deployed_version", "Deployed version", multiprocess_mode="mostrecent")
+        self.request_latency = Histogram("request_latency_seconds", "Request latency", buckets=[0.1, 0.5, 1])
+        self.response_size = Summary("response_size_bytes", "Response size")
+
+
+def worker(fn):
+    pid = os.fork()
+    if pid == 0:
+        fn(Metrics())
+        os._exit(0)
+    os.waitpid(pid, 0)
+
+
+def first(m):
+    m.http_requests.labels(method="get").inc(3)
+    m.http_requests.labels(method="post").inc()
+    m.inprogress_requests.set(2)
+    m.queue_depth.labels(queue="default").set(7)
+    m.free_memory_bytes.set(100)
+    m.jobs_processed.set(4)
+    m.cache_entries.set(10)
+    m.request_latency.observe(0.05)
+    m.request_latency.observe(0.3)
+    m.request_latency.observe(2)
+    m.deployed_version.set(3)
+    m.response_size.observe(100)
+    m.response_size.observe(300)
+
+
+def second(m):
+    m.http_requests.labels(method="get").inc(2)
+    m.inprogress_requests.set(3)
+    m.queue_depth.labels(queue="default").set(4)
+    m.free_memory_bytes.set(50)
+    m.request_latency.observe(0.05)
+    m.request_latency.observe(0.7)
+    m.deployed_version.set(5)
+
+
+def third(m):
+    m.queue_depth.labels(queue="default").set(9)
+    m.jobs_processed.set(6)
+    m.cache_entries.set(12)
+    m.response_size.observe(200)
+    m.deployed_version.set(4)
+
+
+worker(first)
+worker(second)
+worker(third)
@@ -2,37 +2,149 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
 
+	"github.com/errm/promenade/exporter/exposition"
 	"github.com/errm/promenade/exporter/multiprocess"
 	"github.com/errm/promenade/exporter/tcpconnections"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 )
 
 type args struct {
-	Port             int           `arg:"--metrics-port,env:PORT" help:"Port to serve metrics on" default:"9394"`
-	MultiprocessDir  string        `arg:"--multiprocess-dir,env:PROMETHEUS_MULTIPROC_DIR" help:"Directory to read multiprocess metrics from" default:"/app/tmp/promenade"`
-	SamplingInterval time.Duration `arg:"--tcp-sampling-interval,env:TCP_SAMPLING_INTERVAL" help:"How often to sample TCP connection metrics" default:"25ms"`
-	HWMWindow        time.Duration `arg:"--tcp-hwm-window,env:TCP_HWM_WINDOW" help:"TCP high-water mark window; should match your Prometheus scrape interval" default:"30s"`
+	Inspect  *inspectCmd  `arg:"subcommand:inspect" help:"Print the raw entries in multiprocess files"`
+	Validate *validateCmd `arg:"subcommand:validate" help:"Check multiprocess files for corruption, type conflicts and bad filenames"`
+	Render   *renderCmd   `arg:"subcommand:render" help:"Print multiprocess metrics as /metrics would serve them"`
+
+	Port               int            `arg:"--metrics-port,env:PORT" help:"Port to serve metrics on" default:"9394"`
+	MultiprocessDirs   []string       `arg:"--multiprocess-dir,separate,env:PROMETHEUS_MULTIPROC_DIR" help:"Directory to read multiprocess metrics from, or a glob of them, optionally followed by :name=value labels for its metrics; may be repeated [default: /app/tmp/promenade]"`
+	Dialect            string         `arg:"--dialect,env:MULTIPROCESS_DIALECT" help:"Client library that writes the multiprocess files: ruby, python, or auto to detect it per file" default:"auto"`
+	ProcDir            string         `arg:"--proc-dir,env:PROC_DIR" help:"procfs mount used to check whether processes writing live gauges are still running" default:"/proc"`
+	SharedPIDNamespace bool           `arg:"--shared-pid-namespace,env:SHARED_PID_NAMESPACE" help:"Declare that --proc-dir shows the application's pid namespace, so processes missing from it have exited: their live gauges are dropped and their files can be compacted and deleted"`
+	ConfigFile         string         `arg:"--config-file,env:CONFIG_FILE" help:"YAML file of metric_relabel_configs, pid_label_rules and aggregation_overrides to apply to multiprocess metrics"`
+	KeepPIDLabel       bool           `arg:"--keep-pid-label,env:KEEP_PID_LABEL" help:"Serve the raw pid label alongside the labels parsed from it"`
+	CompactionFile     string         `arg:"--compaction-file,env:COMPACTION_FILE" help:"File to keep the totals of counters from exited processes in; compaction is disabled when empty"`
+	SeriesLimit        int            `arg:"--series-limit,env:SERIES_LIMIT" help:"Maximum series served per multiprocess metric family; 0 is unlimited"`
+	FamilySeriesLimits map[string]int `arg:"--family-series-limit,separate,env:FAMILY_SERIES_LIMITS" help:"Per-family series limits as family=limit, overriding --series-limit"`
+	GlobalSeriesLimit  int            `arg:"--global-series-limit,env:GLOBAL_SERIES_LIMIT" help:"Maximum series served across all multiprocess metric families; 0 is unlimited"`
+	ConflictPolicy     string         `arg:"--conflict-policy,env:CONFLICT_POLICY" help:"How to serve a family whose type, gauge mode or histogram buckets differ across files: newest, drop or suffix" default:"newest"`
+	ReconcileBuckets   bool           `arg:"--reconcile-buckets,env:RECONCILE_BUCKETS" help:"Merge histograms written with different buckets onto the union of their bounds, instead of applying --conflict-policy"`
+	FileTTL            time.Duration  `arg:"--file-ttl,env:FILE_TTL" help:"Ignore multiprocess files of any type that haven't been written for this long, unless their process is running; 0 disables"`
+	FileDeleteAfter    time.Duration  `arg:"--file-delete-after,env:FILE_DELETE_AFTER" help:"Delete expired multiprocess files written by exited processes once they haven't been written for this long; 0 disables"`
+	ReadConcurrency    int            `arg:"--read-concurrency,env:READ_CONCURRENCY" help:"Number of multiprocess files to read at once; 0 uses one per CPU"`
+	ForceOpenMetrics   bool           `arg:"--force-openmetrics,env:FORCE_OPENMETRICS" help:"Serve OpenMetrics even to scrapers that don't ask for it in their Accept header"`
+	WebConfigFile      string         `arg:"--web-config-file,env:WEB_CONFIG_FILE" help:"Prometheus exporter-toolkit web config file enabling TLS and basic auth for the metrics server"`
+	SnapshotInterval   time.Duration  `arg:"--snapshot-interval,env:SNAPSHOT_INTERVAL" help:"Read multiprocess files in the background at this interval, and when files are added or removed, instead of on every scrape; 0 disables"`
+	SamplingInterval   time.Duration  `arg:"--tcp-sampling-interval,env:TCP_SAMPLING_INTERVAL" help:"How often to sample TCP connection metrics" default:"25ms"`
+	HWMWindow          time.Duration  `arg:"--tcp-hwm-window,env:TCP_HWM_WINDOW" help:"TCP high-water mark window; should match your Prometheus scrape interval" default:"30s"`
 }
 
 var cfg args
 
-func init() {
+func main() {
 	arg.MustParse(&cfg)
+	switch {
+	case cfg.Inspect != nil:
+		os.Exit(runInspect(cfg.Inspect))
+	case cfg.Validate != nil:
+		os.Exit(runValidate(cfg.Validate))
+	case cfg.Render != nil:
+		os.Exit(runRender(cfg.Render))
+	default:
+		serve()
+	}
 }
 
-func main() {
+// multiprocessOptions configures the multiprocess collector the same way for
+// the server and the render subcommand. With readOnly, expired files are
+// never deleted. The global series limit applies across directories, so it
+// is left to the MultiCollector.
+func multiprocessOptions(readOnly bool) ([]multiprocess.Option, error) {
+	config, err := loadConfig(cfg.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing tells the exporter which Pitchfork or Unicorn worker slots are
+	// in use, so worker_id_N files are always treated as alive
+	liveness := multiprocess.NewProcLiveness(cfg.ProcDir, nil)
+	liveness.SharedNamespace = cfg.SharedPIDNamespace
+	opts := []multiprocess.Option{
+		multiprocess.WithLiveness(liveness),
+		multiprocess.WithSeriesLimits(multiprocess.SeriesLimits{
+			PerFamily: cfg.SeriesLimit,
+			Families:  cfg.FamilySeriesLimits,
+		}),
+	}
+	if len(config.MetricRelabelConfigs) > 0 {
+		relabeler, err := multiprocess.NewRelabeler(config.MetricRelabelConfigs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, multiprocess.WithRelabeler(relabeler))
+	}
+	if len(config.AggregationOverrides) > 0 {
+		aggregator, err := multiprocess.NewAggregator(config.AggregationOverrides)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, multiprocess.WithAggregator(aggregator))
+	}
+	pidLabeler, err := multiprocess.NewPIDLabeler(config.PIDLabelRules, cfg.KeepPIDLabel)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, multiprocess.WithPIDLabeler(pidLabeler))
+	conflictPolicy, err := multiprocess.ParseConflictPolicy(cfg.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, multiprocess.WithConflictPolicy(conflictPolicy))
+	if cfg.ReconcileBuckets {
+		opts = append(opts, multiprocess.WithBucketReconciliation())
+	}
+	if cfg.FileDeleteAfter > 0 && (cfg.FileTTL <= 0 || cfg.FileDeleteAfter < cfg.FileTTL) {
+		return nil, errors.New("--file-delete-after requires --file-ttl, and must be at least as long")
+	}
+	if cfg.FileTTL > 0 {
+		deleteAfter := cfg.FileDeleteAfter
+		if readOnly {
+			deleteAfter = 0
+		}
+		opts = append(opts, multiprocess.WithExpiry(cfg.FileTTL, deleteAfter))
+	}
+	if cfg.ReadConcurrency > 0 {
+		opts = append(opts, multiprocess.WithConcurrency(cfg.ReadConcurrency))
+	}
+	if cfg.Dialect != "auto" {
+		dialect, err := multiprocess.DialectByName(cfg.Dialect)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, multiprocess.WithDialect(dialect))
+	}
+	return opts, nil
+}
+
+func serve() {
+	if err := web.Validate(cfg.WebConfigFile); err != nil {
+		log.Fatalf("Invalid web config file: %v", err)
+	}
+	if (cfg.CompactionFile != "" || cfg.FileDeleteAfter > 0) && !cfg.SharedPIDNamespace {
+		log.Fatal("--compaction-file and --file-delete-after remove files of exited processes, which requires --shared-pid-namespace")
+	}
 	reg := prometheus.NewRegistry()
 
 	serverMetricsCollector, err := tcpconnections.NewCollector(cfg.SamplingInterval, cfg.HWMWindow)
@@ -40,21 +152,90 @@ func main() {
 		log.Fatal(err)
 	}
 
+	opts, err := multiprocessOptions(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirs, err := multiprocessDirs(cfg.MultiprocessDirs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each directory gets its own collector, sharing the exporter's metrics,
+	// built when a glob first matches it
+	metrics := multiprocess.NewMetrics(reg)
+	var compaction *compactionFiles
+	if cfg.CompactionFile != "" {
+		compaction = newCompactionFiles(cfg.CompactionFile, dirs)
+	}
+	dirCollectors := newDirCollectors(dirs, func(dir multiprocessDir) (prometheus.Collector, error) {
+		dirOpts := slices.Concat(opts, []multiprocess.Option{
+			multiprocess.WithMetrics(metrics),
+			multiprocess.WithConstLabels(dir.labels),
+		})
+		if compaction != nil {
+			file, err := compaction.forDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			compactor, err := multiprocess.NewCompactor(file)
+			if err != nil {
+				return nil, err
+			}
+			dirOpts = append(dirOpts, multiprocess.WithCompactor(compactor))
+		}
+
+		collector := multiprocess.NewCollector(dir.path, dirOpts...)
+		if cfg.SnapshotInterval <= 0 {
+			return collector, nil
+		}
+		return multiprocess.NewSnapshotCollector(collector, cfg.SnapshotInterval)
+	})
+	multiprocessCollector := multiprocess.NewMultiCollector(metrics, dirCollectors.collectors,
+		multiprocess.WithGlobalSeriesLimit(cfg.GlobalSeriesLimit),
+	)
+
+	active := []collectorInfo{{
+		Name:        "tcpconnections",
+		Description: fmt.Sprintf("Peak TCP connections per listener, sampled every %s over a %s window", cfg.SamplingInterval, cfg.HWMWindow),
+	}}
+	for _, dir := range dirs {
+		active = append(active, collectorInfo{Name: "multiprocess", Description: describeDir(dir, cfg.SnapshotInterval)})
+	}
+
 	reg.MustRegister(
 		serverMetricsCollector,
-		multiprocess.NewCollector(cfg.MultiprocessDir),
+		multiprocessCollector,
 	)
 
 	addr := ":" + strconv.Itoa(cfg.Port)
 	srv := &http.Server{Addr: addr}
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	http.Handle("/metrics", exposition.Handler(reg, exposition.Options{
+		ForceOpenMetrics: cfg.ForceOpenMetrics,
+		Units:            multiprocessCollector,
+	}))
+	http.Handle("/-/healthy", healthyHandler())
+	http.Handle("/-/ready", readyHandler(dirsExist(dirs), serverMetricsCollector.Ready))
+	effective := cfg
+	if len(effective.MultiprocessDirs) == 0 {
+		effective.MultiprocessDirs = []string{defaultMultiprocessDir}
+	}
+	landing, err := landingPage(active, effectiveConfig(effective))
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/", landing)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
 
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	go func() {
 		log.Printf("Starting metrics server on %s", addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listenAndServe(srv, listener, cfg.WebConfigFile); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -70,4 +251,7 @@ func main() {
 	if err := serverMetricsCollector.Close(); err != nil {
 		log.Printf("Collector close error: %v", err)
 	}
+	if err := dirCollectors.Close(); err != nil {
+		log.Printf("Snapshot collector close error: %v", err)
+	}
 }
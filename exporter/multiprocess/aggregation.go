@@ -0,0 +1,131 @@
+package multiprocess
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Aggregations that can replace the multiprocess mode of a gauge family
+const (
+	AggregateSum   = "sum"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateAvg   = "avg"
+	AggregateCount = "count"
+)
+
+// AggregationConfig overrides how the values of a gauge family are combined
+// across processes, whatever mode its files were written with. It applies
+// to the family called Family, or to every family matching Regex.
+type AggregationConfig struct {
+	Family      string `yaml:"family"`
+	Regex       string `yaml:"regex"`
+	Aggregation string `yaml:"aggregation"`
+	// KeepSeries serves the series of each process alongside the aggregate
+	KeepSeries bool `yaml:"keep_series"`
+}
+
+type aggregationRule struct {
+	family      string
+	regex       *regexp.Regexp
+	aggregation string
+	keepSeries  bool
+}
+
+func (rule aggregationRule) matches(family string) bool {
+	if rule.regex != nil {
+		return rule.regex.MatchString(family)
+	}
+	return rule.family == family
+}
+
+// Aggregator applies aggregation overrides to gauge entries before they are
+// merged. The first matching rule applies.
+type Aggregator struct {
+	rules []aggregationRule
+}
+
+// NewAggregator validates and compiles configs
+func NewAggregator(configs []AggregationConfig) (*Aggregator, error) {
+	a := &Aggregator{}
+	for i, config := range configs {
+		rule := aggregationRule{
+			family:      config.Family,
+			aggregation: config.Aggregation,
+			keepSeries:  config.KeepSeries,
+		}
+		if (config.Family == "") == (config.Regex == "") {
+			return nil, fmt.Errorf("aggregation override %d: exactly one of family or regex is required", i)
+		}
+		if config.Regex != "" {
+			regex, err := regexp.Compile("^(?:" + config.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("aggregation override %d: invalid regex %q: %w", i, config.Regex, err)
+			}
+			rule.regex = regex
+		}
+		switch rule.aggregation {
+		case AggregateSum, AggregateMin, AggregateMax, AggregateAvg, AggregateCount:
+		default:
+			return nil, fmt.Errorf("aggregation override %d: unknown aggregation %q", i, rule.aggregation)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+// rule returns the rule for family, if any
+func (a *Aggregator) rule(family string) (aggregationRule, bool) {
+	if a == nil {
+		return aggregationRule{}, false
+	}
+	for _, rule := range a.rules {
+		if rule.matches(family) {
+			return rule, true
+		}
+	}
+	return aggregationRule{}, false
+}
+
+// aggregate replaces the multiprocess mode of gauges with an override. A
+// count is a sum of ones, and an avg is averaged when entries are merged.
+// Series kept per process are written as the all mode, so they keep their
+// process labels.
+func (c *Collector) aggregate(entries []Entry) []Entry {
+	if c.aggregator == nil || len(c.aggregator.rules) == 0 {
+		return entries
+	}
+
+	rules := make(map[string]*aggregationRule) // family -> rule, or nil for none
+	aggregated := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type != "gauge" {
+			aggregated = append(aggregated, entry)
+			continue
+		}
+		rule, ok := rules[entry.FamilyName]
+		if !ok {
+			if found, matched := c.aggregator.rule(entry.FamilyName); matched {
+				rule = &found
+			}
+			rules[entry.FamilyName] = rule
+		}
+		if rule == nil {
+			aggregated = append(aggregated, entry)
+			continue
+		}
+
+		if rule.keepSeries {
+			series := entry
+			series.MultiprocessMode = "all"
+			aggregated = append(aggregated, series)
+		}
+		entry.MultiprocessMode = rule.aggregation
+		if rule.aggregation == AggregateCount {
+			entry.MultiprocessMode = AggregateSum
+			entry.Value = 1
+		}
+		aggregated = append(aggregated, entry)
+	}
+	return aggregated
+}
@@ -0,0 +1,129 @@
+package multiprocess
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector_Aggregation(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "gauge_all_worker_id_1-0.db"),
+		testEntry{key: `["pitchfork_memory_usage_bytes","pitchfork_memory_usage_bytes",[],[]]`, value: 100},
+		testEntry{key: `["queue_depth","queue_depth",[],[]]`, value: 5},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_all_worker_id_2-0.db"),
+		testEntry{key: `["pitchfork_memory_usage_bytes","pitchfork_memory_usage_bytes",[],[]]`, value: 300},
+		testEntry{key: `["queue_depth","queue_depth",[],[]]`, value: 7},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_max_worker_id_3-0.db"),
+		testEntry{key: `["pitchfork_memory_usage_bytes","pitchfork_memory_usage_bytes",[],[]]`, value: 200},
+	)
+
+	queueDepth := `
+# HELP queue_depth Multiprocess metric
+# TYPE queue_depth gauge
+queue_depth{worker="1"} 5
+queue_depth{worker="2"} 7
+`
+	tests := []struct {
+		name     string
+		config   AggregationConfig
+		expected string
+	}{
+		{
+			name:   "sum",
+			config: AggregationConfig{Family: "pitchfork_memory_usage_bytes", Aggregation: AggregateSum},
+			expected: `
+# HELP pitchfork_memory_usage_bytes Multiprocess metric
+# TYPE pitchfork_memory_usage_bytes gauge
+pitchfork_memory_usage_bytes 600
+`,
+		},
+		{
+			name:   "min",
+			config: AggregationConfig{Family: "pitchfork_memory_usage_bytes", Aggregation: AggregateMin},
+			expected: `
+# HELP pitchfork_memory_usage_bytes Multiprocess metric
+# TYPE pitchfork_memory_usage_bytes gauge
+pitchfork_memory_usage_bytes 100
+`,
+		},
+		{
+			name:   "max",
+			config: AggregationConfig{Family: "pitchfork_memory_usage_bytes", Aggregation: AggregateMax},
+			expected: `
+# HELP pitchfork_memory_usage_bytes Multiprocess metric
+# TYPE pitchfork_memory_usage_bytes gauge
+pitchfork_memory_usage_bytes 300
+`,
+		},
+		{
+			name:   "avg",
+			config: AggregationConfig{Family: "pitchfork_memory_usage_bytes", Aggregation: AggregateAvg},
+			expected: `
+# HELP pitchfork_memory_usage_bytes Multiprocess metric
+# TYPE pitchfork_memory_usage_bytes gauge
+pitchfork_memory_usage_bytes 200
+`,
+		},
+		{
+			name:   "count",
+			config: AggregationConfig{Family: "pitchfork_memory_usage_bytes", Aggregation: AggregateCount},
+			expected: `
+# HELP pitchfork_memory_usage_bytes Multiprocess metric
+# TYPE pitchfork_memory_usage_bytes gauge
+pitchfork_memory_usage_bytes 3
+`,
+		},
+		{
+			name:   "keep series",
+			config: AggregationConfig{Regex: "pitchfork_.*", Aggregation: AggregateSum, KeepSeries: true},
+			expected: `
+# HELP pitchfork_memory_usage_bytes Multiprocess metric
+# TYPE pitchfork_memory_usage_bytes gauge
+pitchfork_memory_usage_bytes 600
+pitchfork_memory_usage_bytes{worker="1"} 100
+pitchfork_memory_usage_bytes{worker="2"} 300
+pitchfork_memory_usage_bytes{worker="3"} 200
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregator, err := NewAggregator([]AggregationConfig{tt.config})
+			if err != nil {
+				t.Fatal(err)
+			}
+			collector := NewCollector(dir,
+				WithLiveness(allAlive),
+				// The max file doesn't conflict with the all files, as
+				// the override replaces both modes
+				WithAggregator(aggregator),
+				WithConflictPolicy(ConflictDrop),
+			)
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected+queueDepth)); err != nil {
+				t.Errorf("CollectAndCompare failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewAggregator_Invalid(t *testing.T) {
+	tests := map[string]AggregationConfig{
+		"no family or regex":  {Aggregation: AggregateSum},
+		"family and regex":    {Family: "a", Regex: "a", Aggregation: AggregateSum},
+		"invalid regex":       {Regex: "(", Aggregation: AggregateSum},
+		"unknown aggregation": {Family: "a", Aggregation: "median"},
+		"missing aggregation": {Family: "a"},
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewAggregator([]AggregationConfig{config}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package multiprocess
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// fileCache remembers the entries decoded from each file between scrapes.
+//
+// The Ruby client only ever appends entries to a file and updates values in
+// place, so while a file keeps its identity (same inode) and its used header
+// doesn't shrink, the keys decoded on a previous scrape are still valid. Each
+// file keeps a Reader, which decodes only the entries appended since then;
+// existing entries just have their 8-byte values re-read.
+//
+// Files are mapped read-only, like the Ruby client maps them for writing, so
+// values are read in place without copying the file. Where mmap isn't
+// available the used part of the file is read into a buffer instead.
+//
+// Each file is locked separately, so different files can be read at the same
+// time, by one scrape's workers or by concurrent scrapes.
+type fileCache struct {
+	mu    sync.Mutex // guards files, but not their contents
+	files map[string]*cachedFile
+	mmap  bool
+}
+
+type cachedFile struct {
+	mu      sync.Mutex  // guards the fields below, held while the mapping is read
+	removed bool        // no longer in the cache, so must not be mapped again
+	stat    os.FileInfo // identifies the inode the entries were decoded from
+	reader  *Reader     // decodes the file's entries, remembering them between scrapes
+	grown   time.Time   // when the used header was last seen to change, or the mtime when first read
+	mapped  []byte      // read-only mapping of the file, if mmap succeeded
+	noMmap  bool        // mmap failed, so fall back to reading
+	buf     []byte      // reused between scrapes to avoid allocating per read
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{
+		files: make(map[string]*cachedFile),
+		mmap:  true,
+	}
+}
+
+// entries returns the current entries in the file described by info,
+// decoding only what has changed since the last call. It also returns the
+// number of bytes of the file that were read and the entries newly skipped
+// because they couldn't be decoded, and sets info.modified to when the file
+// was last written as of now.
+func (c *fileCache) entries(info *FileInfo, now time.Time) ([]Entry, int, []error, error) {
+	f, err := os.Open(info.Path)
+	if err != nil {
+		c.remove(info.Path)
+		return nil, 0, nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		c.remove(info.Path)
+		return nil, 0, nil, err
+	}
+
+	cached := c.file(info.Path)
+	defer cached.mu.Unlock()
+
+	if cached.stat == nil || !os.SameFile(cached.stat, stat) {
+		cached.reset()
+		cached.stat = stat
+		// The Reader is handed the file's mapping, rather than reading it
+		cached.reader = newReader(info, nil, 0)
+	}
+
+	previous := cached.reader.used
+	entries, used, skipped, err := cached.refresh(f, int(stat.Size()))
+	if err != nil {
+		cached.reset()
+		return nil, 0, nil, err
+	}
+
+	// Writes through a mapping don't always update the mtime, but new
+	// entries move the used header
+	switch {
+	case cached.grown.IsZero():
+		cached.grown = stat.ModTime()
+	case cached.reader.used != previous:
+		cached.grown = now
+	}
+	info.modified = stat.ModTime()
+	if cached.grown.After(info.modified) {
+		info.modified = cached.grown
+	}
+
+	stampEntries(entries, stat.ModTime())
+	return entries, used, skipped, nil
+}
+
+// file returns the cached state for path, creating it if needed. It is
+// returned locked.
+func (c *fileCache) file(path string) *cachedFile {
+	for {
+		c.mu.Lock()
+		cached, ok := c.files[path]
+		if !ok {
+			cached = &cachedFile{noMmap: !c.mmap}
+			c.files[path] = cached
+		}
+		c.mu.Unlock()
+
+		cached.mu.Lock()
+		if !cached.removed {
+			return cached
+		}
+		// Removed while we waited for it, so look again
+		cached.mu.Unlock()
+	}
+}
+
+// refresh has the file's Reader decode any new entries and update the values
+// of existing ones. Entries that can't be decoded are skipped, and reported
+// only once.
+func (cf *cachedFile) refresh(f *os.File, size int) (entries []Entry, used int, skipped []error, err error) {
+	if size < headerSize {
+		return nil, 0, nil, nil
+	}
+
+	if !cf.noMmap {
+		// A file truncated under the mapping faults on access rather than
+		// returning an error, so turn that into one.
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("fault reading mapped file: %v", r)
+			}
+		}()
+	}
+
+	data, used, err := cf.data(f, size)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	entries, skipped, err = cf.reader.decode(data, used)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if !cf.reader.cumulative() {
+		entries = accumulateBuckets(entries)
+	}
+	return entries, used, skipped, nil
+}
+
+// data returns the contents of the file up to at least its used header,
+// from the mapping when possible and by reading it otherwise, along with the
+// header. The header is read once, so it matches the data decoded even while
+// the file is being appended to.
+func (cf *cachedFile) data(f *os.File, size int) ([]byte, int, error) {
+	if !cf.noMmap {
+		if cf.mapped != nil && size < len(cf.mapped) {
+			// Shrunk under our mapping; remap so we never read past the end
+			cf.unmap()
+		}
+		if cf.mapped != nil {
+			if used, err := usedBytes(cf.mapped, len(cf.mapped)); err == nil {
+				return cf.mapped, used, nil
+			}
+			// The file grew beyond the mapping
+			cf.unmap()
+		}
+		mapped, err := mmapFile(f, size)
+		if err == nil {
+			cf.mapped = mapped
+			used, err := usedBytes(cf.mapped, len(cf.mapped))
+			if err != nil {
+				return nil, 0, err
+			}
+			return cf.mapped, used, nil
+		}
+		cf.noMmap = true
+	}
+
+	if cap(cf.buf) < headerSize {
+		cf.buf = make([]byte, headerSize)
+	}
+	header := cf.buf[:headerSize]
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, 0, err
+	}
+	used, err := usedBytes(header, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cap(cf.buf) < used {
+		cf.buf = make([]byte, used)
+	}
+	data := cf.buf[:used]
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, 0, err
+	}
+	return data, used, nil
+}
+
+func (cf *cachedFile) unmap() {
+	if cf.mapped != nil {
+		munmap(cf.mapped)
+		cf.mapped = nil
+	}
+}
+
+// reset forgets everything decoded from the file, releasing its mapping
+func (cf *cachedFile) reset() {
+	cf.unmap()
+	cf.stat = nil
+	cf.reader = nil
+	cf.grown = time.Time{}
+}
+
+// remove forgets a file, releasing its mapping once nobody is reading it
+func (c *fileCache) remove(path string) {
+	c.mu.Lock()
+	cached, ok := c.files[path]
+	delete(c.files, path)
+	c.mu.Unlock()
+
+	if ok {
+		cached.mu.Lock()
+		cached.reset()
+		cached.removed = true
+		cached.mu.Unlock()
+	}
+}
+
+// retain removes cached files whose path is not in paths
+func (c *fileCache) retain(paths map[string]bool) {
+	c.mu.Lock()
+	var removed []string
+	for path := range c.files {
+		if !paths[path] {
+			removed = append(removed, path)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, path := range removed {
+		c.remove(path)
+	}
+}
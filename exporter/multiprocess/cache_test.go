@@ -0,0 +1,365 @@
+package multiprocess
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testFileSize mirrors the initial size of files created by the Ruby client,
+// leaving room to append entries in place.
+const testFileSize = 4096
+
+type testEntry struct {
+	key   string
+	value float64
+}
+
+// encodeEntry encodes an entry in the prometheus-client-mmap layout
+func encodeEntry(e testEntry) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(e.key)))
+	buf = append(buf, e.key...)
+	buf = append(buf, strings.Repeat(" ", paddingLen(len(e.key)))...)
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(e.value))
+}
+
+// writeDB writes a .db file containing entries, padded to testFileSize
+func writeDB(t testing.TB, path string, entries ...testEntry) {
+	t.Helper()
+	data := make([]byte, headerSize)
+	for _, e := range entries {
+		data = append(data, encodeEntry(e)...)
+	}
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	if len(data) < testFileSize {
+		data = append(data, make([]byte, testFileSize-len(data))...)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// appendDB appends an entry to an existing file in place, the way the Ruby
+// client does, keeping the same inode.
+func appendDB(t testing.TB, path string, e testEntry) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	used := binary.LittleEndian.Uint32(header)
+	encoded := encodeEntry(e)
+	if _, err := f.WriteAt(encoded, int64(used)); err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(header, used+uint32(len(encoded)))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setValue overwrites the value of the entry at index in place
+func setValue(t testing.TB, path string, index int, value float64) {
+	t.Helper()
+	entries, _, err := readEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(binary.LittleEndian.AppendUint64(nil, math.Float64bits(value)), int64(entries[index].valueOffset)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCache_Incremental(t *testing.T) {
+	for _, mmap := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mmap=%v", mmap), func(t *testing.T) {
+			testFileCacheIncremental(t, mmap)
+		})
+	}
+}
+
+func testFileCacheIncremental(t *testing.T, mmap bool) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter_process_id_1-0.db")
+	writeDB(t, path, testEntry{`["jobs_total","jobs_total",["queue"],["default"]]`, 1})
+
+	collector := NewCollector(dir, WithLiveness(allAlive))
+	collector.cache.mmap = mmap
+	expect := func(expected string) {
+		t.Helper()
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+			t.Errorf("CollectAndCompare failed: %v", err)
+		}
+	}
+
+	expect(`
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total{queue="default"} 1
+`)
+	first := collector.cache.files[path].reader.entries[0].labels
+
+	// Values updated in place are picked up
+	setValue(t, path, 0, 5)
+	expect(`
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total{queue="default"} 5
+`)
+
+	// Appended entries are decoded, existing ones are not decoded again
+	appendDB(t, path, testEntry{`["jobs_total","jobs_total",["queue"],["mailers"]]`, 2})
+	expect(`
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total{queue="default"} 5
+jobs_total{queue="mailers"} 2
+`)
+	cached := collector.cache.files[path]
+	if len(cached.reader.entries) != 2 {
+		t.Fatalf("expected 2 cached entries, got %d", len(cached.reader.entries))
+	}
+	if reflect.ValueOf(cached.reader.entries[0].labels).Pointer() != reflect.ValueOf(first).Pointer() {
+		t.Error("expected the first entry to be reused rather than decoded again")
+	}
+
+	// Files that grow beyond their original size are remapped
+	for i := range 100 {
+		appendDB(t, path, testEntry{fmt.Sprintf(`["jobs_total","jobs_total",["queue"],["q%03d"]]`, i), 1})
+	}
+	if count := testutil.CollectAndCount(collector); count != 102 {
+		t.Errorf("expected 102 series after growing the file, got %d", count)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() <= testFileSize {
+		t.Fatalf("expected the file to grow beyond %d bytes: %v", testFileSize, err)
+	}
+
+	// A replaced file is decoded from scratch
+	replacement := filepath.Join(dir, "replacement")
+	writeDB(t, replacement, testEntry{`["jobs_total","jobs_total",["queue"],["low"]]`, 3})
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	expect(`
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total{queue="low"} 3
+`)
+
+	// Removed files are forgotten
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect(``)
+	if len(collector.cache.files) != 0 {
+		t.Errorf("expected removed file to be dropped from the cache, got %d files", len(collector.cache.files))
+	}
+}
+
+func TestFileCache_RetriesLastEntry(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter_process_id_1-0.db")
+	writeDB(t, path,
+		testEntry{`["jobs_total","jobs_total",["queue"],["default"]]`, 1},
+		testEntry{`["jobs_total","jobs_total",["queue"],["mailers"]]`, 2},
+	)
+
+	// Tear the last entry, as if its bytes weren't visible yet when the used
+	// header was
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := headerSize + len(encodeEntry(testEntry{`["jobs_total","jobs_total",["queue"],["default"]]`, 1}))
+	complete := slices.Clone(data[last:])
+	clear(data[last : last+20])
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics(nil)
+	collector := NewCollector(dir, WithLiveness(allAlive), WithMetrics(metrics))
+	if count := testutil.CollectAndCount(collector); count != 1 {
+		t.Errorf("expected the entry before the torn one to be served, got %d series", count)
+	}
+	// It is retried on the next scrape, but only reported once
+	testutil.CollectAndCount(collector)
+	if got := testutil.ToFloat64(metrics.entriesSkipped.WithLabelValues("corrupted_entry")); got != 1 {
+		t.Errorf("expected the torn entry to be skipped once, got %v", got)
+	}
+
+	// Once it is complete, it is decoded
+	copy(data[last:], complete)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total{queue="default"} 1
+jobs_total{queue="mailers"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
+
+func TestFileCache_ReportsCorruptLastEntryOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"),
+		testEntry{`["jobs_total","jobs_total",["queue"],["default"]]`, 1},
+		testEntry{`["jobs_total","jobs_total",["queue"]`, 2},
+	)
+
+	// The last entry is complete, so it can't be in flight: it is skipped
+	// rather than retried and reported on every scrape
+	metrics := NewMetrics(nil)
+	collector := NewCollector(dir, WithLiveness(allAlive), WithMetrics(metrics))
+	for range 2 {
+		if count := testutil.CollectAndCount(collector); count != 1 {
+			t.Errorf("expected the entry before the corrupt one to be served, got %d series", count)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.entriesSkipped.WithLabelValues("json")); got != 1 {
+		t.Errorf("expected the corrupt entry to be skipped once, got %v", got)
+	}
+}
+
+// writeBenchmarkDir writes files with entries each, shaped like a busy Rails app
+func writeBenchmarkDir(b *testing.B, files, entries int) string {
+	b.Helper()
+	dir := b.TempDir()
+	for f := range files {
+		var es []testEntry
+		for e := range entries {
+			es = append(es, testEntry{
+				key:   fmt.Sprintf(`["http_requests_total","http_requests_total",["controller","action","status"],["controller_%d","action_%d","200"]]`, e%50, e),
+				value: float64(e),
+			})
+		}
+		writeDB(b, filepath.Join(dir, fmt.Sprintf("counter_process_id_%d-0.db", f)), es...)
+	}
+	return dir
+}
+
+func BenchmarkReadEntries(b *testing.B) {
+	dir := writeBenchmarkDir(b, 64, 500)
+	files, err := filepath.Glob(filepath.Join(dir, "*.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// parse reads and decodes every file from scratch, as Collect used to
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, path := range files {
+				if _, _, err := readEntries(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached/mmap=%v", mmap), func(b *testing.B) {
+			cache := newFileCache()
+			cache.mmap = mmap
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, path := range files {
+					info, err := ParseFilename(path)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, _, _, err := cache.entries(info, time.Now()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFileData isolates getting a file's bytes on a warm scrape, which
+// the mapping does without copying them. Decoding dominates the scrape as a
+// whole, so BenchmarkReadEntries barely shows the difference.
+func BenchmarkFileData(b *testing.B) {
+	dir := writeBenchmarkDir(b, 1, 5000)
+	path := filepath.Join(dir, "counter_process_id_0-0.db")
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			cached := &cachedFile{noMmap: !mmap}
+			defer cached.unmap()
+			if _, _, err := cached.data(f, int(stat.Size())); err != nil {
+				b.Fatal(err)
+			}
+			if mmap && cached.mapped == nil {
+				b.Skip("mmap is not supported here")
+			}
+			b.SetBytes(stat.Size())
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, _, err := cached.data(f, int(stat.Size())); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	dir := writeBenchmarkDir(b, 500, 100)
+
+	// Compare with -cpu to see how the speedup depends on available cores
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		// cold decodes every file, as on the first scrape
+		b.Run(fmt.Sprintf("cold/concurrency=%d", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				collector := NewCollector(dir, WithLiveness(allAlive), WithConcurrency(concurrency))
+				collector.gather()
+			}
+		})
+
+		// warm only re-reads values, as on every later scrape
+		b.Run(fmt.Sprintf("warm/concurrency=%d", concurrency), func(b *testing.B) {
+			collector := NewCollector(dir, WithLiveness(allAlive), WithConcurrency(concurrency))
+			collector.gather()
+			b.ReportAllocs()
+			for b.Loop() {
+				collector.gather()
+			}
+		})
+	}
+}
@@ -3,15 +3,23 @@ package multiprocess
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"iter"
+	"log"
 	"maps"
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -27,6 +35,8 @@ type FileInfo struct {
 	MultiprocessMode string
 	PID              string
 	Data             []byte
+	modified         time.Time  // when the file was last written, from its mtime or used header
+	dialects         []*Dialect // candidates for decoding the contents, most likely first
 }
 
 // Entry represents a parsed metric entry
@@ -38,8 +48,19 @@ type Entry struct {
 	FamilyName       string
 	MetricName       string
 	labels           map[string]string
+	pidLabels        map[string]string // identify the process in place of the pid label, when set
+	samples          int               // values summed into an avg, which is divided once merged
+	help             string            // help text recorded in the key, by dialects that have one
+	timestamp        float64           // unix time the value was written, from the entry or the file's mtime
+	modTime          float64           // unix time the entry's file was last modified
+	offset           int               // byte offset of the entry within its file
+	valueOffset      int               // byte offset of the value within its file
+	timestampOffset  int               // byte offset of the timestamp within its file, if the layout has one
+	compacted        bool              // from the aggregate of exited processes' files rather than a file
 }
 
+// Labels returns the labels the entry is served with, including the labels
+// identifying its process when it keeps one series per process
 func (e Entry) Labels() prometheus.Labels {
 	labels := make(prometheus.Labels)
 	for k, v := range e.labels {
@@ -49,11 +70,48 @@ func (e Entry) Labels() prometheus.Labels {
 		labels[k] = v
 	}
 	if e.isPIDSignificant() {
-		labels["pid"] = e.PID
+		pidLabels := e.pidLabels
+		if pidLabels == nil {
+			pidLabels = map[string]string{"pid": e.PID}
+		}
+		for name, value := range pidLabels {
+			// The application's own labels win, and a pid label with the same
+			// name is served prefixed, as Prometheus does with target labels
+			for _, taken := e.labels[name]; taken; _, taken = e.labels[name] {
+				name = "exported_" + name
+			}
+			labels[name] = value
+		}
 	}
 	return labels
 }
 
+// RawLabels returns the labels stored in the entry's key, including le and
+// quantile, without the labels identifying its process
+func (e Entry) RawLabels() map[string]string {
+	return maps.Clone(e.labels)
+}
+
+// Help returns the help text stored in the entry's key, by dialects that
+// record one
+func (e Entry) Help() string {
+	return e.help
+}
+
+// Timestamp returns when the value was written: from the entry if its layout
+// records it, otherwise from its file's mtime. It is zero when neither is known.
+func (e Entry) Timestamp() time.Time {
+	if e.timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(e.timestamp*float64(time.Second)))
+}
+
+// Offset returns the byte offset of the entry within its file
+func (e Entry) Offset() int {
+	return e.offset
+}
+
 func (e Entry) upperBound() (float64, error) {
 	if le, ok := e.labels["le"]; ok {
 		if le == "+Inf" {
@@ -66,11 +124,20 @@ func (e Entry) upperBound() (float64, error) {
 
 // isPIDSignificant determines if PID is exposed in labels
 func (e Entry) isPIDSignificant() bool {
-	return e.PID != "" &&
-		e.Type == "gauge" &&
-		e.MultiprocessMode != "min" &&
-		e.MultiprocessMode != "max" &&
-		e.MultiprocessMode != "livesum"
+	if e.PID == "" || e.Type != "gauge" {
+		return false
+	}
+	switch aggregation(e.MultiprocessMode) {
+	case "min", "max", "sum", "avg", "mostrecent":
+		return false
+	}
+	return true
+}
+
+// aggregation returns how a gauge mode combines values from different
+// processes. The live variants aggregate the same way, over running processes.
+func aggregation(mode string) string {
+	return strings.TrimPrefix(mode, "live")
 }
 
 func (e Entry) mergeKey() string {
@@ -96,12 +163,162 @@ func (e Entry) groupKey() string {
 
 // Collector implements prometheus.Collector to read metrics from .db files
 type Collector struct {
-	dir string
+	dir         string
+	liveness    Liveness
+	compactor   *Compactor
+	cache       *fileCache
+	metadata    *metadataCache
+	metrics     *Metrics
+	limits      SeriesLimits
+	limitLog    *rateLimiter
+	relabeler   *Relabeler
+	aggregator  *Aggregator
+	conflicts   ConflictPolicy
+	reconcile   bool
+	conflictLog *rateLimiter
+	dialects    []*Dialect
+	concurrency int
+	ttl         time.Duration
+	deleteAfter time.Duration
+	now         func() time.Time
+	pidLabeler  *PIDLabeler
+	pidLabels   *pidLabelCache
+	constLabels prometheus.Labels
+	units       atomic.Pointer[map[string]string]
+}
+
+// Option configures optional Collector behaviour
+type Option func(*Collector)
+
+// WithLiveness sets the source used to decide which processes are still
+// running, for the liveall and livesum gauge modes. It defaults to checking /proc.
+func WithLiveness(liveness Liveness) Option {
+	return func(c *Collector) {
+		c.liveness = liveness
+	}
+}
+
+// WithCompactor folds counters, histograms and summaries from exited
+// processes into the given Compactor's aggregate, so they never go backwards.
+func WithCompactor(compactor *Compactor) Option {
+	return func(c *Collector) {
+		c.compactor = compactor
+	}
+}
+
+// WithMetrics records the collector's own metrics in m, which should be
+// registered by the caller with NewMetrics.
+func WithMetrics(m *Metrics) Option {
+	return func(c *Collector) {
+		c.metrics = m
+	}
+}
+
+// WithSeriesLimits caps the number of series served per family and in total.
+func WithSeriesLimits(limits SeriesLimits) Option {
+	return func(c *Collector) {
+		c.limits = limits
+	}
+}
+
+// WithRelabeler applies relabeling rules to entries before they are merged.
+func WithRelabeler(relabeler *Relabeler) Option {
+	return func(c *Collector) {
+		c.relabeler = relabeler
+	}
+}
+
+// WithConflictPolicy sets how families seen with different types, modes or
+// bucket layouts are served. It defaults to ConflictNewest.
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(c *Collector) {
+		c.conflicts = policy
+	}
+}
+
+// WithBucketReconciliation merges histograms written with different bucket
+// layouts onto the union of their bounds, instead of treating them as a
+// conflict.
+func WithBucketReconciliation() Option {
+	return func(c *Collector) {
+		c.reconcile = true
+	}
+}
+
+// WithExpiry ignores files of every type that haven't been written for ttl,
+// such as those left behind by a previous release, unless their process is
+// known to be running. It deletes them once they haven't been written for
+// deleteAfter if their process is known to have exited. A deleteAfter of zero
+// never deletes files.
+func WithExpiry(ttl, deleteAfter time.Duration) Option {
+	return func(c *Collector) {
+		c.ttl = ttl
+		c.deleteAfter = deleteAfter
+	}
+}
+
+// WithPIDLabeler sets how the processes that wrote gauges with one series per
+// process are identified. By default the pid providers of prometheus-client-mmap
+// and Promenade are recognised, e.g. worker_id_3 is served as worker="3".
+func WithPIDLabeler(labeler *PIDLabeler) Option {
+	return func(c *Collector) {
+		c.pidLabeler = labeler
+	}
+}
+
+// WithAggregator overrides how gauge families are combined across processes.
+func WithAggregator(aggregator *Aggregator) Option {
+	return func(c *Collector) {
+		c.aggregator = aggregator
+	}
+}
+
+// WithConstLabels adds labels to every metric served, e.g. to tell apart the
+// directories of different applications. They replace labels of the same name
+// written by the application.
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(c *Collector) {
+		c.constLabels = labels
+	}
+}
+
+// WithDialect only reads files written in dialect, instead of detecting the
+// dialect of each file.
+func WithDialect(dialect *Dialect) Option {
+	return func(c *Collector) {
+		c.dialects = []*Dialect{dialect}
+	}
+}
+
+// WithConcurrency sets how many files are read at once. It defaults to
+// GOMAXPROCS.
+func WithConcurrency(n int) Option {
+	return func(c *Collector) {
+		c.concurrency = max(n, 1)
+	}
 }
 
 // NewCollector creates a new collector that discovers .db files in the given directory
-func NewCollector(dir string) *Collector {
-	return &Collector{dir: dir}
+func NewCollector(dir string, opts ...Option) *Collector {
+	c := &Collector{
+		dir:         dir,
+		liveness:    NewProcLiveness("/proc", nil),
+		cache:       newFileCache(),
+		metadata:    newMetadataCache(dir),
+		metrics:     NewMetrics(nil),
+		limitLog:    newRateLimiter(limitLogInterval),
+		conflicts:   ConflictNewest,
+		conflictLog: newRateLimiter(limitLogInterval),
+		dialects:    dialects,
+		concurrency: runtime.GOMAXPROCS(0),
+		now:         time.Now,
+		pidLabeler:  defaultPIDLabeler(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.pidLabels = newPIDLabelCache(c.pidLabeler)
+	return c
 }
 
 // Describe implements prometheus.Collector
@@ -113,45 +330,316 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect implements prometheus.Collector
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range c.gather() {
+		ch <- metric
+	}
+}
+
+// gather reads and merges every file in the directory into metrics
+func (c *Collector) gather() []prometheus.Metric {
+	timer := prometheus.NewTimer(c.metrics.collectDuration)
+	defer timer.ObserveDuration()
+
 	// Discover all .db files in the directory
 	files, err := filepath.Glob(filepath.Join(c.dir, "*.db"))
 	if err != nil {
 		// If directory doesn't exist or can't be read, return silently
 		// This allows the collector to work even if the directory is created later
-		return
+		return nil
 	}
+	c.metrics.filesDiscovered.Add(float64(len(files)))
+	now := c.now()
 
-	// Parse all files and collect entries
+	// Read files in parallel, then compact and merge them in the order they
+	// were found, so the output doesn't depend on which worker finished first
 	var allEntries []Entry
-	for _, filepath := range files {
-		info, err := parseFileInfo(filepath)
-		if err != nil {
-			continue // Skip files that can't be read
+	for _, file := range c.readFiles(files, now) {
+		if file.info == nil {
+			continue
 		}
-
-		entries, err := parseEntries(info)
-		if err != nil {
-			continue // Skip files that can't be parsed
+		if c.compact(file.info, file.entries) {
+			continue // Values are now counted in the aggregate
 		}
+		if c.expire(file.info, now) {
+			continue
+		}
+		allEntries = append(allEntries, file.entries...)
+	}
 
-		allEntries = append(allEntries, entries...)
+	// Forget about files that have been removed
+	paths := make(map[string]bool, len(files))
+	names := make(map[string]bool, len(files))
+	for _, path := range files {
+		paths[path] = true
+		names[filepath.Base(path)] = true
 	}
+	c.cache.retain(paths)
+
+	if c.compactor != nil {
+		if err := c.compactor.Prune(names); err != nil {
+			log.Printf("Compaction error: %v", err)
+		}
+		allEntries = append(allEntries, c.compactor.Entries()...)
+	}
+
+	metadata := c.metadata.load()
+	allEntries = c.relabel(allEntries)
+	allEntries = c.reconcileBuckets(allEntries)
+	allEntries = c.resolveConflicts(allEntries, metadata)
+	allEntries = c.aggregate(allEntries)
 
 	// Merge entries
-	merged := mergeEntries(allEntries)
-	grouped := groupEntries(merged)
+	merged := c.labelPIDs(Merge(allEntries))
+	grouped := c.applyLimits(Group(merged))
 
 	// Convert entries to Prometheus metrics
+	var metrics []prometheus.Metric
+	units := make(map[string]string)
+	seen := make(map[string]bool) // series keys, when const labels could make two the same
 	for entry := range grouped {
-		metric, err := entriesToMetric(entry)
+		md := metadata[entry[0].FamilyName]
+		if md.Help == "" {
+			md.Help = entry[0].help
+		}
+		labels := entry[0].Labels()
+		replaced := replacedLabels(labels, c.constLabels)
+		maps.Copy(labels, c.constLabels)
+		metric, err := entriesToMetric(entry, md, labels)
 		if err != nil {
-			continue // Skip invalid entries
+			if reason := invalidHistogramReason(err); reason != "" {
+				c.metrics.invalidHistograms.WithLabelValues(entry[0].FamilyName, reason).Inc()
+				if c.limitLog.allow("histogram:" + entry[0].FamilyName) {
+					if metric != nil {
+						log.Printf("Serving histogram %s with its +Inf bucket as its count: %v", entry[0].FamilyName, err)
+					} else {
+						log.Printf("Skipped invalid histogram %s: %v", entry[0].FamilyName, err)
+					}
+				}
+			}
+			if metric == nil {
+				c.metrics.invalidMetrics.Inc()
+				continue // Skip invalid entries
+			}
 		}
-		ch <- metric
+		served := newServedMetric(metric, entry[0], md.help(), labels)
+		if len(c.constLabels) > 0 {
+			key := served.key()
+			if seen[key] {
+				c.constLabelCollision(served.name, key, replaced)
+				continue
+			}
+			seen[key] = true
+		}
+		c.metrics.seriesEmitted.Inc()
+		if md.Unit != "" {
+			units[served.name] = md.Unit
+		}
+		metrics = append(metrics, served)
+	}
+	c.units.Store(&units)
+	return metrics
+}
+
+// replacedLabels returns the names of the labels that const labels replace
+func replacedLabels(labels, constLabels prometheus.Labels) []string {
+	var replaced []string
+	for name := range constLabels {
+		if _, ok := labels[name]; ok {
+			replaced = append(replaced, name)
+		}
+	}
+	slices.Sort(replaced)
+	return replaced
+}
+
+// constLabelCollision reports a series not served because a const label
+// replaced the label that set it apart from another series of the directory.
+// The collision is within the directory, so MultiCollector never sees it.
+func (c *Collector) constLabelCollision(name, key string, replaced []string) {
+	c.metrics.seriesCollisions.WithLabelValues(name, "const_label").Inc()
+	if len(replaced) == 0 {
+		// The series served before it was the one written with the label
+		replaced = slices.Sorted(maps.Keys(c.constLabels))
+	}
+	if c.limitLog.allow("const:" + name) {
+		log.Printf("Not serving %s twice: const label %s replaces a label it was written with (%s)", name, strings.Join(replaced, ", "), key)
+	}
+}
+
+// Units returns the units declared in the metadata sidecar for the families
+// served by the latest collection, by the name they are served under
+func (c *Collector) Units() map[string]string {
+	if units := c.units.Load(); units != nil {
+		return *units
+	}
+	return nil
+}
+
+// labelPIDs sets the labels identifying the process on entries that keep one
+// series per process. Every pid is needed to tell whether two are labelled
+// the same, so the entries are read before any are yielded.
+func (c *Collector) labelPIDs(entries iter.Seq[Entry]) iter.Seq[Entry] {
+	var all []Entry
+	pids := make(map[string]bool)
+	for entry := range entries {
+		if entry.isPIDSignificant() {
+			pids[entry.PID] = true
+		}
+		all = append(all, entry)
+	}
+
+	labels, collisions := c.pidLabels.label(pids)
+	for _, group := range collisions {
+		if c.limitLog.allow("pids:" + strings.Join(group, ",")) {
+			log.Printf("Processes %s have the same pid labels, so they are told apart by their pid label", strings.Join(group, ", "))
+		}
+	}
+
+	return func(yield func(Entry) bool) {
+		for _, entry := range all {
+			if entry.isPIDSignificant() {
+				entry.pidLabels = labels[entry.PID]
+			}
+			if !yield(entry) {
+				return
+			}
+		}
+	}
+}
+
+// fileResult is the result of reading one file. info is nil if it was skipped.
+type fileResult struct {
+	info    *FileInfo
+	entries []Entry
+}
+
+// readFiles reads files with up to c.concurrency workers, returning the
+// results in the same order as files.
+func (c *Collector) readFiles(files []string, now time.Time) []fileResult {
+	results := make([]fileResult, len(files))
+	paths := make(chan int)
+	var wg sync.WaitGroup
+	for range min(c.concurrency, len(files)) {
+		wg.Go(func() {
+			for i := range paths {
+				results[i] = c.readFile(files[i], now)
+			}
+		})
+	}
+	for i := range files {
+		paths <- i
+	}
+	close(paths)
+	wg.Wait()
+	return results
+}
+
+// readFile reads the entries in the file at path, unless it should be skipped
+func (c *Collector) readFile(path string, now time.Time) fileResult {
+	info, err := parseFilenameAs(path, c.dialects)
+	if err != nil {
+		c.metrics.filesFailed.WithLabelValues(failureReason(err)).Inc()
+		return fileResult{} // Skip files that don't follow the naming convention
+	}
+
+	if c.compactor != nil && c.compactor.Folded(info.Path) {
+		return fileResult{} // Values are already counted in the aggregate
+	}
+
+	if !c.isLive(info) {
+		return fileResult{} // Skip live* gauges written by processes that have exited
+	}
+
+	entries, bytesRead, skipped, err := c.cache.entries(info, now)
+	if err != nil {
+		c.metrics.filesFailed.WithLabelValues(failureReason(err)).Inc()
+		return fileResult{} // Skip files that can't be read or parsed
+	}
+	for _, err := range skipped {
+		c.metrics.entriesSkipped.WithLabelValues(failureReason(err)).Inc()
+	}
+	if len(skipped) > 0 && c.limitLog.allow("skipped:"+info.Path) {
+		log.Printf("Skipped %d corrupted entries in %s: %v", len(skipped), filepath.Base(info.Path), skipped[0])
+	}
+	c.metrics.filesParsed.Inc()
+	c.metrics.entriesRead.Add(float64(len(entries)))
+	c.metrics.bytesRead.Add(float64(bytesRead))
+
+	return fileResult{info: info, entries: entries}
+}
+
+// isLive reports whether the values in a file should be included. Only
+// liveall and livesum gauges depend on their writer still running.
+func (c *Collector) isLive(info *FileInfo) bool {
+	if info.Type != "gauge" || !isLiveMode(info.MultiprocessMode) {
+		return true
+	}
+	return c.liveness.Alive(info.PID)
+}
+
+// expire reports whether a file hasn't been written within the TTL, and so
+// should be ignored. Once it is past deleteAfter too it is deleted, if the
+// process that wrote it is known to have exited and can't write to it again.
+func (c *Collector) expire(info *FileInfo, now time.Time) bool {
+	if c.ttl <= 0 {
+		return false
+	}
+	age := now.Sub(info.modified)
+	if age < c.ttl {
+		return false
+	}
+	state := processState(c.liveness, info.PID)
+	if state == ProcessRunning {
+		// Its values just haven't changed. Ignoring them until they do would
+		// look like a counter reset, and make per-process gauges flap.
+		return false
+	}
+	c.metrics.filesExpired.Inc()
+
+	if c.deleteAfter > 0 && age >= c.deleteAfter && state == ProcessExited {
+		if err := os.Remove(info.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to delete expired file %s: %v", info.Path, err)
+			return true
+		}
+		c.cache.remove(info.Path)
+		c.metrics.filesDeleted.Inc()
+		log.Printf("Deleted %s: not written for %s", filepath.Base(info.Path), age.Truncate(time.Second))
 	}
+	return true
 }
 
-func groupEntries(entries iter.Seq[Entry]) iter.Seq[[]Entry] {
+// compact folds a file written by a process known to have exited into the
+// aggregate, reporting whether it did so.
+func (c *Collector) compact(info *FileInfo, entries []Entry) bool {
+	if c.compactor == nil || !isCompactable(info) || processState(c.liveness, info.PID) != ProcessExited {
+		return false
+	}
+	if err := c.compactor.Fold(info, entries); err != nil {
+		log.Printf("Compaction error: %v", err)
+		// Fold leaves the aggregate unchanged unless only the removal failed
+		return c.compactor.Folded(info.Path)
+	}
+	return true
+}
+
+// relabel applies the relabeling rules, if any, dropping entries they reject
+func (c *Collector) relabel(entries []Entry) []Entry {
+	if c.relabeler == nil {
+		return entries
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if relabeled, ok := c.relabeler.Relabel(entry); ok {
+			kept = append(kept, relabeled)
+		}
+	}
+	return kept
+}
+
+// Group collects merged entries into the series they are served as: each
+// histogram or summary is one group of its buckets, count and sum, and every
+// other entry is a group of its own.
+func Group(entries iter.Seq[Entry]) iter.Seq[[]Entry] {
 	groups := make(map[string][]Entry)
 	for entry := range entries {
 		key := entry.groupKey()
@@ -160,8 +648,10 @@ func groupEntries(entries iter.Seq[Entry]) iter.Seq[[]Entry] {
 	return maps.Values(groups)
 }
 
-// entriesToHistogram converts histogram entries (buckets, count, sum) to a single histogram metric
-func entriesToHistogram(entries []Entry) (prometheus.Metric, error) {
+// entriesToHistogram converts histogram entries (buckets, count, sum) to a single histogram metric.
+// A count that differs from the +Inf bucket is returned as errCountMismatch
+// along with the metric, which is still served.
+func entriesToHistogram(entries []Entry, metadata Metadata, labels prometheus.Labels) (prometheus.Metric, error) {
 	if len(entries) == 0 {
 		return nil, fmt.Errorf("no entries provided")
 	}
@@ -175,7 +665,9 @@ func entriesToHistogram(entries []Entry) (prometheus.Metric, error) {
 			if err != nil {
 				return nil, err
 			}
-			buckets[upperBound] = uint64(entry.Value)
+			// Sum rather than overwrite, as bounds may be spelled differently
+			// by different processes (1 and 1.0) and so not have been merged
+			buckets[upperBound] += uint64(entry.Value)
 		} else if strings.HasSuffix(entry.MetricName, "_count") {
 			count = entry.Value
 		} else if strings.HasSuffix(entry.MetricName, "_sum") {
@@ -183,21 +675,30 @@ func entriesToHistogram(entries []Entry) (prometheus.Metric, error) {
 		}
 	}
 
-	return prometheus.NewConstHistogram(
+	served, err := validateBuckets(buckets, uint64(count))
+	if err != nil && !errors.Is(err, errCountMismatch) {
+		return nil, err
+	}
+
+	metric, histErr := prometheus.NewConstHistogram(
 		prometheus.NewDesc(
 			entries[0].FamilyName,
-			"Multiprocess metric",
+			metadata.help(),
 			nil,
-			entries[0].Labels(),
+			labels,
 		),
-		uint64(count),
+		served,
 		sum,
 		buckets,
 	)
+	if histErr != nil {
+		return nil, histErr
+	}
+	return metric, err
 }
 
 // entriesToSummary converts summary entries (count, sum) to a single summary metric
-func entriesToSummary(entries []Entry) (prometheus.Metric, error) {
+func entriesToSummary(entries []Entry, metadata Metadata, labels prometheus.Labels) (prometheus.Metric, error) {
 	if len(entries) == 0 {
 		return nil, fmt.Errorf("no entries provided")
 	}
@@ -217,9 +718,9 @@ func entriesToSummary(entries []Entry) (prometheus.Metric, error) {
 	return prometheus.NewConstSummary(
 		prometheus.NewDesc(
 			entries[0].FamilyName,
-			"Multiprocess metric",
+			metadata.help(),
 			nil,
-			entries[0].Labels(),
+			labels,
 		),
 		uint64(count),
 		sum,
@@ -227,7 +728,7 @@ func entriesToSummary(entries []Entry) (prometheus.Metric, error) {
 	)
 }
 
-func entriesToMetric(entries []Entry) (prometheus.Metric, error) {
+func entriesToMetric(entries []Entry, metadata Metadata, labels prometheus.Labels) (prometheus.Metric, error) {
 	entry := entries[0]
 	// Determine value type
 	var valueType prometheus.ValueType
@@ -237,9 +738,9 @@ func entriesToMetric(entries []Entry) (prometheus.Metric, error) {
 	case "gauge":
 		valueType = prometheus.GaugeValue
 	case "histogram":
-		return entriesToHistogram(entries)
+		return entriesToHistogram(entries, metadata, labels)
 	case "summary":
-		return entriesToSummary(entries)
+		return entriesToSummary(entries, metadata, labels)
 	default:
 		valueType = prometheus.UntypedValue
 	}
@@ -247,55 +748,25 @@ func entriesToMetric(entries []Entry) (prometheus.Metric, error) {
 	return prometheus.NewConstMetric(
 		prometheus.NewDesc(
 			entry.MetricName,
-			"Multiprocess metric",
+			metadata.help(),
 			nil,
-			entry.Labels(),
+			labels,
 		),
 		valueType,
 		entry.Value,
 	)
 }
 
-// parseFileInfo extracts metadata from filename and reads file contents
-func parseFileInfo(path string) (*FileInfo, error) {
-	basename := filepath.Base(path)
-	name := strings.TrimSuffix(basename, ".db")
-
-	parts := strings.Split(name, "_")
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid filename format: %s", basename)
-	}
-
-	// Remove trailing -number from parts
-	for i, part := range parts {
-		if idx := strings.LastIndex(part, "-"); idx > 0 {
-			parts[i] = part[:idx]
-		}
-	}
-
-	info := &FileInfo{
-		Path:             path,
-		Type:             parts[0],
-		MultiprocessMode: parts[1],
-	}
-
-	if len(parts) > 2 {
-		info.PID = strings.Join(parts[2:], "_")
-	}
-
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	info.Data = data
-	return info, nil
+// ParseFilename extracts metadata from the filename without reading the
+// file, detecting which dialect it was written in
+func ParseFilename(path string) (*FileInfo, error) {
+	return parseFilenameAs(path, dialects)
 }
 
 // readU32 reads a little-endian u32 from the buffer
 func readU32(buf []byte, offset int) (uint32, error) {
 	if offset+4 > len(buf) {
-		return 0, fmt.Errorf("out of bounds: offset %d, len %d", offset, len(buf))
+		return 0, fmt.Errorf("%w: offset %d, len %d", ErrTruncated, offset, len(buf))
 	}
 	return binary.LittleEndian.Uint32(buf[offset:]), nil
 }
@@ -303,7 +774,7 @@ func readU32(buf []byte, offset int) (uint32, error) {
 // readF64 reads a little-endian f64 from the buffer
 func readF64(buf []byte, offset int) (float64, error) {
 	if offset+8 > len(buf) {
-		return 0, fmt.Errorf("out of bounds: offset %d, len %d", offset, len(buf))
+		return 0, fmt.Errorf("%w: offset %d, len %d", ErrTruncated, offset, len(buf))
 	}
 	bits := binary.LittleEndian.Uint64(buf[offset:])
 	return math.Float64frombits(bits), nil
@@ -314,94 +785,215 @@ func paddingLen(encodedLen int) int {
 	return 8 - (4+encodedLen)%8
 }
 
-// parseEntries parses all entries from file data
+// parseEntries parses all entries from file data. Entries that can't be
+// decoded are skipped and reported in the error, which is a join of
+// *EntryError, alongside the entries that could be.
 func parseEntries(info *FileInfo) ([]Entry, error) {
 	if len(info.Data) < headerSize {
 		return nil, nil
 	}
 
-	used, err := readU32(info.Data, 0)
+	used, err := usedBytes(info.Data, len(info.Data))
 	if err != nil {
 		return nil, err
 	}
 
-	if int(used) > len(info.Data) {
-		return nil, fmt.Errorf("corrupted file: used %d > file size %d", used, len(info.Data))
+	entries, skipped, err := newReader(info, nil, 0).decode(info.Data, used)
+	if err != nil {
+		return nil, err
 	}
+	return entries, errors.Join(skipped...)
+}
 
-	var entries []Entry
-	pos := headerSize
+// detectLayout decodes all the entries in data with the first of the file's
+// candidate layouts that decodes every one of them. If none do, the layout
+// that skips the fewest entries, then decodes the most, is used.
+func detectLayout(info *FileInfo, data []byte, used int) (layout, []Entry, int, []error) {
+	candidates := info.dialects
+	if len(candidates) == 0 {
+		candidates = dialects
+	}
 
-	for pos+4 < int(used) {
-		encodedLen, err := readU32(info.Data, pos)
-		if err != nil {
-			return nil, err
+	var (
+		best        layout
+		bestEntries []Entry
+		bestEnd     int
+		bestSkipped []error
+		found       bool
+	)
+	for _, dialect := range candidates {
+		for _, size := range dialect.valueSizes {
+			l := layout{dialect: dialect, valueSize: size}
+			entries, end, skipped := decodeEntries(info, l, data, headerSize, used)
+			if len(skipped) == 0 {
+				return l, entries, end, nil
+			}
+			if !found || len(skipped) < len(bestSkipped) ||
+				(len(skipped) == len(bestSkipped) && len(entries) > len(bestEntries)) {
+				best, bestEntries, bestEnd, bestSkipped, found = l, entries, end, skipped, true
+			}
 		}
+	}
+	return best, bestEntries, bestEnd, bestSkipped
+}
 
-		pos += 4
-		if pos+int(encodedLen) > len(info.Data) {
-			return nil, fmt.Errorf("corrupted entry at pos %d", pos-4)
-		}
+// usedBytes reads the used header, checking it against the file size
+func usedBytes(data []byte, size int) (int, error) {
+	used, err := readU32(data, 0)
+	if err != nil {
+		return 0, err
+	}
 
-		jsonBytes := info.Data[pos : pos+int(encodedLen)]
-		pos += int(encodedLen)
+	if int(used) > size {
+		return 0, fmt.Errorf("%w: used %d > file size %d", ErrTruncated, used, size)
+	}
+	return int(used), nil
+}
 
-		padding := paddingLen(int(encodedLen))
-		pos += padding
+// maxKeyLen bounds the length of an entry's key, so that a corrupted length
+// is recognised as one rather than read as a key spanning most of the file.
+// Real keys are far shorter.
+const maxKeyLen = 1 << 16
 
-		if pos+8 > len(info.Data) {
-			return nil, fmt.Errorf("corrupted value at pos %d", pos)
+// decodeEntries decodes the entries in data between pos and used, returning
+// them along with the position decoding stopped at. An entry that can't be
+// decoded is skipped and reported as an *EntryError. When its length can't
+// be trusted either, decoding resumes at the next plausible entry.
+//
+// The last entry may still be being written when its length isn't visible
+// yet or runs past used, so decoding stops before it, to try it again from
+// there next time. Any other entry that can't be decoded is decoded past, so that it is
+// only reported once.
+func decodeEntries(info *FileInfo, l layout, data []byte, pos, used int) ([]Entry, int, []error) {
+	data = data[:used]
+	var (
+		entries []Entry
+		skipped []error
+	)
+	for pos+4 < used {
+		entry, next, err := decodeEntry(info, l, data, pos)
+		if err == nil {
+			entries = append(entries, entry)
+			pos = next
+			continue
 		}
-
-		value, err := readF64(info.Data, pos)
-		if err != nil {
-			return nil, err
+		if next == pos {
+			next = resync(l, data, pos+8)
 		}
-		pos += 8
-
-		// Parse JSON to extract familyName, metricName, and labels
-		var parts []interface{}
-		var familyName, metricName string
-		labels := make(map[string]string)
-		if err := json.Unmarshal(jsonBytes, &parts); err == nil && len(parts) >= 4 {
-			familyName, _ = parts[0].(string)
-			metricName, _ = parts[1].(string)
-			labelList, _ := parts[2].([]interface{})
-			labelValues, _ := parts[3].([]interface{})
-			for i, label := range labelList {
-				if i < len(labelValues) {
-					labelStr, _ := label.(string)
-					value := labelValues[i]
-					var valueStr string
-					switch v := value.(type) {
-					case string:
-						valueStr = v
-					case nil:
-						valueStr = ""
-					default:
-						valueStr = fmt.Sprintf("%v", v)
-					}
-					labels[labelStr] = valueStr
-				}
+		skipped = append(skipped, &EntryError{Offset: pos, Err: err})
+		if next >= used {
+			if inFlight(l, data, pos) {
+				return entries, pos, skipped
 			}
+			return entries, used, skipped
 		}
+		pos = next
+	}
+	if pos < used {
+		skipped = append(skipped, &EntryError{Offset: pos, Err: fmt.Errorf("%w: %d bytes too short for an entry", ErrTruncated, used-pos)})
+	}
+	return entries, used, skipped
+}
 
-		entries = append(entries, Entry{
-			PID:              info.PID,
-			Type:             info.Type,
-			MultiprocessMode: info.MultiprocessMode,
-			Value:            value,
-			FamilyName:       familyName,
-			MetricName:       metricName,
-			labels:           labels,
-		})
+// inFlight reports whether the entry at pos could still be being written:
+// its length isn't visible yet, or is plausible but runs past the end of data
+func inFlight(l layout, data []byte, pos int) bool {
+	encodedLen, err := readU32(data, pos)
+	if err != nil || encodedLen > maxKeyLen {
+		return false
+	}
+	return encodedLen == 0 || pos+4+int(encodedLen)+paddingLen(int(encodedLen))+l.valueSize > len(data)
+}
+
+// entryEnd returns the position after the entry at pos, if the length of its
+// key is plausible and the entry fits in data
+func entryEnd(l layout, data []byte, pos int) (int, error) {
+	encodedLen, err := readU32(data, pos)
+	if err != nil {
+		return 0, err
+	}
+	if encodedLen == 0 || encodedLen > maxKeyLen {
+		return 0, fmt.Errorf("%w: key length %d", ErrCorruptedEntry, encodedLen)
+	}
+	end := pos + 4 + int(encodedLen) + paddingLen(int(encodedLen)) + l.valueSize
+	if end > len(data) {
+		return 0, fmt.Errorf("%w: entry of %d bytes overruns the file", ErrCorruptedEntry, end-pos)
+	}
+	return end, nil
+}
+
+// decodeEntry decodes the entry at pos, returning the position after it. If
+// the entry's length can't be trusted, that position is pos.
+func decodeEntry(info *FileInfo, l layout, data []byte, pos int) (Entry, int, error) {
+	end, err := entryEnd(l, data, pos)
+	if err != nil {
+		return Entry{}, pos, err
+	}
+	encodedLen := int(binary.LittleEndian.Uint32(data[pos:]))
+	jsonBytes := data[pos+4 : pos+4+encodedLen]
+
+	// Layouts with room for a timestamp write it straight after the value
+	valueOffset := end - l.valueSize
+	value := math.Float64frombits(binary.LittleEndian.Uint64(data[valueOffset:]))
+	var timestamp float64
+	var timestampOffset int
+	if l.valueSize >= 16 {
+		timestampOffset = valueOffset + 8
+		timestamp = math.Float64frombits(binary.LittleEndian.Uint64(data[timestampOffset:]))
+	}
+
+	// Parse JSON to extract familyName, metricName, and labels
+	var parts []interface{}
+	if err := json.Unmarshal(jsonBytes, &parts); err != nil {
+		return Entry{}, end, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(parts) < 4 {
+		return Entry{}, end, fmt.Errorf("%w: expected 4 elements, got %d", ErrInvalidKey, len(parts))
+	}
+	key, err := l.dialect.decodeKey(parts)
+	if err != nil {
+		return Entry{}, end, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if err := key.validate(); err != nil {
+		return Entry{}, end, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 	}
 
-	return entries, nil
+	return Entry{
+		PID:              info.PID,
+		Type:             info.Type,
+		MultiprocessMode: info.MultiprocessMode,
+		Value:            value,
+		FamilyName:       key.familyName,
+		MetricName:       key.metricName,
+		labels:           key.labels,
+		help:             key.help,
+		timestamp:        timestamp,
+		offset:           pos,
+		valueOffset:      valueOffset,
+		timestampOffset:  timestampOffset,
+	}, end, nil
+}
+
+// resync returns the first position from pos, in steps of the 8 bytes
+// entries are aligned to, that holds an entry with a plausible length and a
+// JSON array for a key, or the end of data if there is none
+func resync(l layout, data []byte, pos int) int {
+	for ; pos+4 < len(data); pos += 8 {
+		if _, err := entryEnd(l, data, pos); err != nil {
+			continue
+		}
+		key := data[pos+4 : pos+4+int(binary.LittleEndian.Uint32(data[pos:]))]
+		if key[0] == '[' && json.Valid(key) {
+			return pos
+		}
+	}
+	return len(data)
 }
 
-// mergeEntries merges entries with the same metric identity
-func mergeEntries(allEntries []Entry) iter.Seq[Entry] {
+// Merge combines entries with the same metric identity from different
+// processes: gauges according to their multiprocess mode, and everything
+// else by summing.
+func Merge(allEntries []Entry) iter.Seq[Entry] {
 	merged := make(map[string]Entry)
 
 	for _, entry := range allEntries {
@@ -409,7 +1001,7 @@ func mergeEntries(allEntries []Entry) iter.Seq[Entry] {
 		if existing, ok := merged[key]; ok {
 			// Merge values based on type and multiprocess mode
 			if existing.Type == "gauge" {
-				switch existing.MultiprocessMode {
+				switch aggregation(existing.MultiprocessMode) {
 				case "min":
 					if entry.Value < existing.Value {
 						existing.Value = entry.Value
@@ -418,8 +1010,19 @@ func mergeEntries(allEntries []Entry) iter.Seq[Entry] {
 					if entry.Value > existing.Value {
 						existing.Value = entry.Value
 					}
-				case "livesum":
+				case "sum":
+					existing.Value += entry.Value
+				case "avg":
 					existing.Value += entry.Value
+					existing.samples++
+				case "mostrecent":
+					// Ties go to the highest PID, so the result doesn't depend on file order
+					if entry.timestamp > existing.timestamp ||
+						(entry.timestamp == existing.timestamp && entry.PID > existing.PID) {
+						existing.Value = entry.Value
+						existing.timestamp = entry.timestamp
+						existing.PID = entry.PID
+					}
 				default:
 					existing.Value = entry.Value
 				}
@@ -428,9 +1031,16 @@ func mergeEntries(allEntries []Entry) iter.Seq[Entry] {
 			}
 			merged[key] = existing
 		} else {
+			entry.samples = 1
 			merged[key] = entry
 		}
 	}
 
+	for key, entry := range merged {
+		if entry.Type == "gauge" && aggregation(entry.MultiprocessMode) == "avg" {
+			entry.Value /= float64(entry.samples)
+			merged[key] = entry
+		}
+	}
 	return maps.Values(merged)
 }
@@ -1,13 +1,56 @@
 package multiprocess
 
 import (
+	"bytes"
+	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
 )
 
+// allAlive treats every writer as running, so results don't depend on which
+// PIDs happen to exist on the test host.
+var allAlive = LivenessFunc(func(string) bool { return true })
+
+// fixtureTimes pins the mtimes of fixtures whose values depend on them, as
+// git doesn't preserve mtimes. mostrecent gauges written without a timestamp
+// per entry fall back to the file's mtime. They are set on copies, so the
+// fixtures themselves are left alone.
+var fixtureTimes = map[string]time.Duration{
+	"gauge/gauge_mostrecent_process_id_59891-0.db":     0,
+	"gauge/gauge_mostrecent_process_id_59892-0.db":     20 * time.Second,
+	"gauge/gauge_mostrecent_process_id_59893-0.db":     10 * time.Second,
+	"gauge/gauge_livemostrecent_process_id_59891-0.db": 30 * time.Second,
+	"gauge/gauge_livemostrecent_process_id_59893-0.db": 5 * time.Second,
+	// Newest by mtime, but the entry timestamps say otherwise
+	"python/gauge_mostrecent_4101.db": time.Hour,
+}
+
+// fixtureDir copies a fixture, or the fixtures matching a pattern, into a
+// temporary directory with the mtimes their values depend on
+func fixtureDir(t *testing.T, fixture string) string {
+	t.Helper()
+	dir := copyFixtures(t, fixture)
+	base := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	for name, offset := range fixtureTimes {
+		if match, _ := filepath.Match(fixture, filepath.Dir(name)); !match {
+			continue
+		}
+		mtime := base.Add(offset)
+		if err := os.Chtimes(filepath.Join(dir, filepath.Base(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
 func TestCollector_Collect(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -33,6 +76,9 @@ widgets_created_total 30
 			name:    "gauge",
 			fixture: "gauge",
 			expected: `
+# HELP boiler_temperature_celsius Multiprocess metric
+# TYPE boiler_temperature_celsius gauge
+boiler_temperature_celsius 60
 # HELP greenhouse_temperature_celsius Multiprocess metric
 # TYPE greenhouse_temperature_celsius gauge
 greenhouse_temperature_celsius{greenhouse="inside"} 54.3
@@ -41,19 +87,22 @@ greenhouse_temperature_celsius{greenhouse="inside"} 54.3
 outside_temperature_celsius{sensor="garden"} 10.9
 # HELP oven_temperature_celsius Multiprocess metric
 # TYPE oven_temperature_celsius gauge
-oven_temperature_celsius{oven="grill",pid="process_id_59891"} 22
-oven_temperature_celsius{oven="top",pid="process_id_59891"} 150.1
-oven_temperature_celsius{oven="top",pid="process_id_59892"} 150.2
-oven_temperature_celsius{oven="top",pid="process_id_59893"} 155.2
+oven_temperature_celsius{oven="grill",process_id="59891"} 22
+oven_temperature_celsius{oven="top",process_id="59891"} 150.1
+oven_temperature_celsius{oven="top",process_id="59892"} 150.2
+oven_temperature_celsius{oven="top",process_id="59893"} 155.2
 # HELP room_temperature_celsius Multiprocess metric
 # TYPE room_temperature_celsius gauge
 room_temperature_celsius{room="broom_cupboard"} 15.37
 room_temperature_celsius{room="kitchen"} 25.45
 room_temperature_celsius{room="lounge"} 22.4
+# HELP thermostat_setpoint_celsius Multiprocess metric
+# TYPE thermostat_setpoint_celsius gauge
+thermostat_setpoint_celsius{zone="upstairs"} 21
 # HELP water_temperature_celsius Multiprocess metric
 # TYPE water_temperature_celsius gauge
-water_temperature_celsius{pid="process_id_59891"} 32.1
-water_temperature_celsius{pid="process_id_59893"} 33.1
+water_temperature_celsius{process_id="59891"} 32.1
+water_temperature_celsius{process_id="59893"} 33.1
 `,
 		},
 		{
@@ -104,6 +153,49 @@ http_request_duration_sum{method="GET"} 10.919999999999998
 # TYPE api_client_http_timing summary
 api_client_http_timing_count{method="get",path="/api/v1/users"} 6
 api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+`,
+		},
+		{
+			// Written by prometheus_client, whose histogram buckets aren't cumulative
+			name:    "python",
+			fixture: "python",
+			expected: `
+# HELP cache_entries Entries in the cache
+# TYPE cache_entries gauge
+cache_entries{process_id="4101"} 10
+cache_entries{process_id="4102"} 0
+cache_entries{process_id="4103"} 12
+# HELP deployed_version Deployed version
+# TYPE deployed_version gauge
+deployed_version 4
+# HELP free_memory_bytes Free memory
+# TYPE free_memory_bytes gauge
+free_memory_bytes 0
+# HELP http_requests_total HTTP requests handled
+# TYPE http_requests_total counter
+http_requests_total{method="get"} 5
+http_requests_total{method="post"} 1
+# HELP inprogress_requests Requests in progress
+# TYPE inprogress_requests gauge
+inprogress_requests 5
+# HELP jobs_processed Jobs processed
+# TYPE jobs_processed gauge
+jobs_processed 10
+# HELP queue_depth Deepest queue seen
+# TYPE queue_depth gauge
+queue_depth{queue="default"} 9
+# HELP request_latency_seconds Request latency
+# TYPE request_latency_seconds histogram
+request_latency_seconds_bucket{le="0.1"} 2
+request_latency_seconds_bucket{le="0.5"} 3
+request_latency_seconds_bucket{le="1"} 4
+request_latency_seconds_bucket{le="+Inf"} 5
+request_latency_seconds_sum 3.1
+request_latency_seconds_count 5
+# HELP response_size_bytes Response size
+# TYPE response_size_bytes summary
+response_size_bytes_sum 600
+response_size_bytes_count 3
 `,
 		},
 		{
@@ -114,6 +206,14 @@ api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
 # TYPE api_client_http_timing summary
 api_client_http_timing_count{method="get",path="/api/v1/users"} 6
 api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+# HELP boiler_temperature_celsius Multiprocess metric
+# TYPE boiler_temperature_celsius gauge
+boiler_temperature_celsius 60
+# HELP cache_entries Entries in the cache
+# TYPE cache_entries gauge
+cache_entries{process_id="4101"} 10
+cache_entries{process_id="4102"} 0
+cache_entries{process_id="4103"} 12
 # HELP calculator_time_taken Multiprocess metric
 # TYPE calculator_time_taken histogram
 calculator_time_taken_bucket{le="0.25",operation="add"} 1
@@ -132,6 +232,12 @@ calculator_time_taken_count{operation="add"} 11
 calculator_time_taken_count{operation="subtract"} 7
 calculator_time_taken_sum{operation="add"} 32.75
 calculator_time_taken_sum{operation="subtract"} 3.75
+# HELP deployed_version Deployed version
+# TYPE deployed_version gauge
+deployed_version 4
+# HELP free_memory_bytes Free memory
+# TYPE free_memory_bytes gauge
+free_memory_bytes 0
 # HELP greenhouse_temperature_celsius Multiprocess metric
 # TYPE greenhouse_temperature_celsius gauge
 greenhouse_temperature_celsius{greenhouse="inside"} 54.3
@@ -151,24 +257,52 @@ http_request_duration_bucket{le="10",method="GET"} 9
 http_request_duration_bucket{le="+Inf",method="GET"} 9
 http_request_duration_count{method="GET"} 9
 http_request_duration_sum{method="GET"} 10.919999999999998
+# HELP http_requests_total HTTP requests handled
+# TYPE http_requests_total counter
+http_requests_total{method="get"} 5
+http_requests_total{method="post"} 1
+# HELP inprogress_requests Requests in progress
+# TYPE inprogress_requests gauge
+inprogress_requests 5
+# HELP jobs_processed Jobs processed
+# TYPE jobs_processed gauge
+jobs_processed 10
 # HELP outside_temperature_celsius Multiprocess metric
 # TYPE outside_temperature_celsius gauge
 outside_temperature_celsius{sensor="garden"} 10.9
 # HELP oven_temperature_celsius Multiprocess metric
 # TYPE oven_temperature_celsius gauge
-oven_temperature_celsius{oven="grill",pid="process_id_59891"} 22
-oven_temperature_celsius{oven="top",pid="process_id_59891"} 150.1
-oven_temperature_celsius{oven="top",pid="process_id_59892"} 150.2
-oven_temperature_celsius{oven="top",pid="process_id_59893"} 155.2
+oven_temperature_celsius{oven="grill",process_id="59891"} 22
+oven_temperature_celsius{oven="top",process_id="59891"} 150.1
+oven_temperature_celsius{oven="top",process_id="59892"} 150.2
+oven_temperature_celsius{oven="top",process_id="59893"} 155.2
+# HELP queue_depth Deepest queue seen
+# TYPE queue_depth gauge
+queue_depth{queue="default"} 9
+# HELP request_latency_seconds Request latency
+# TYPE request_latency_seconds histogram
+request_latency_seconds_bucket{le="0.1"} 2
+request_latency_seconds_bucket{le="0.5"} 3
+request_latency_seconds_bucket{le="1"} 4
+request_latency_seconds_bucket{le="+Inf"} 5
+request_latency_seconds_sum 3.1
+request_latency_seconds_count 5
+# HELP response_size_bytes Response size
+# TYPE response_size_bytes summary
+response_size_bytes_sum 600
+response_size_bytes_count 3
 # HELP room_temperature_celsius Multiprocess metric
 # TYPE room_temperature_celsius gauge
 room_temperature_celsius{room="broom_cupboard"} 15.37
 room_temperature_celsius{room="kitchen"} 25.45
 room_temperature_celsius{room="lounge"} 22.4
+# HELP thermostat_setpoint_celsius Multiprocess metric
+# TYPE thermostat_setpoint_celsius gauge
+thermostat_setpoint_celsius{zone="upstairs"} 21
 # HELP water_temperature_celsius Multiprocess metric
 # TYPE water_temperature_celsius gauge
-water_temperature_celsius{pid="process_id_59891"} 32.1
-water_temperature_celsius{pid="process_id_59893"} 33.1
+water_temperature_celsius{process_id="59891"} 32.1
+water_temperature_celsius{process_id="59893"} 33.1
 # HELP widgets_created_total Multiprocess metric
 # TYPE widgets_created_total counter
 widgets_created_total 30
@@ -180,11 +314,8 @@ widgets_created_total{type="murphys"} 61
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Get the path to the test fixtures
-			fixtureDir := filepath.Join("test_fixtures", tt.fixture)
-
-			// Create a collector pointing to the test fixtures
-			collector := NewCollector(fixtureDir)
+			// Create a collector pointing to a copy of the test fixtures
+			collector := NewCollector(fixtureDir(t, tt.fixture), WithLiveness(allAlive))
 
 			// Use CollectAndCompare to compare collected metrics with expected output
 			expectedReader := strings.NewReader(tt.expected)
@@ -205,3 +336,144 @@ widgets_created_total{type="murphys"} 61
 		})
 	}
 }
+
+func TestCollector_MostRecent(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		liveness Liveness
+		expected string
+	}{
+		{
+			name:     "newest file mtime wins",
+			fixture:  "gauge",
+			liveness: allAlive,
+			expected: `
+# HELP boiler_temperature_celsius Multiprocess metric
+# TYPE boiler_temperature_celsius gauge
+boiler_temperature_celsius 60
+# HELP thermostat_setpoint_celsius Multiprocess metric
+# TYPE thermostat_setpoint_celsius gauge
+thermostat_setpoint_celsius{zone="upstairs"} 21
+`,
+		},
+		{
+			name:     "livemostrecent ignores dead processes",
+			fixture:  "gauge",
+			liveness: exited("process_id_59891", "process_id_59892"),
+			expected: `
+# HELP boiler_temperature_celsius Multiprocess metric
+# TYPE boiler_temperature_celsius gauge
+boiler_temperature_celsius 65
+# HELP thermostat_setpoint_celsius Multiprocess metric
+# TYPE thermostat_setpoint_celsius gauge
+thermostat_setpoint_celsius{zone="upstairs"} 21
+`,
+		},
+		{
+			name:     "entry timestamps win over mtime",
+			fixture:  "python",
+			liveness: allAlive,
+			expected: `
+# HELP deployed_version Deployed version
+# TYPE deployed_version gauge
+deployed_version 4
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := NewCollector(fixtureDir(t, tt.fixture), WithLiveness(tt.liveness))
+			names := []string{"boiler_temperature_celsius", "thermostat_setpoint_celsius", "deployed_version"}
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected), names...); err != nil {
+				t.Errorf("CollectAndCompare failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+		mode string
+		pid  string
+	}{
+		{name: "counter_process_id_673-0.db", typ: "counter", pid: "process_id_673"},
+		{name: "histogram_worker_id_3-0.db", typ: "histogram", pid: "worker_id_3"},
+		{name: "gauge_livesum_process_id_59891-0.db", typ: "gauge", mode: "livesum", pid: "process_id_59891"},
+		{name: "gauge_all_worker_id_1-0.db", typ: "gauge", mode: "all", pid: "worker_id_1"},
+		{name: "counter_1234.db", typ: "counter", pid: "1234"},
+		{name: "gauge_livemostrecent_1234.db", typ: "gauge", mode: "livemostrecent", pid: "1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseFilename(filepath.Join("dir", tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Type != tt.typ || info.MultiprocessMode != tt.mode || info.PID != tt.pid {
+				t.Errorf("got type=%q mode=%q pid=%q, want type=%q mode=%q pid=%q",
+					info.Type, info.MultiprocessMode, info.PID, tt.typ, tt.mode, tt.pid)
+			}
+		})
+	}
+}
+
+// render returns the exposition text served for collector
+func render(t testing.TB, collector prometheus.Collector) string {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func TestCollector_ConcurrencyIsDeterministic(t *testing.T) {
+	// Floating point sums depend on their order, so these only come out the
+	// same if files are merged in the same order however they are read
+	dir := t.TempDir()
+	for i := range 100 {
+		writeDB(t, filepath.Join(dir, fmt.Sprintf("counter_process_id_%d-0.db", i)),
+			testEntry{key: `["work_seconds","work_seconds_total",[],[]]`, value: 0.1 * float64(i%7)},
+			testEntry{key: `["work_seconds","work_seconds_total",["queue"],["a"]]`, value: 1.0 / float64(i+1)},
+		)
+	}
+
+	expected := render(t, NewCollector(dir, WithLiveness(allAlive), WithConcurrency(1)))
+	for _, concurrency := range []int{2, 8, 64} {
+		if got := render(t, NewCollector(dir, WithLiveness(allAlive), WithConcurrency(concurrency))); got != expected {
+			t.Errorf("concurrency %d: got\n%s\nwant\n%s", concurrency, got, expected)
+		}
+	}
+}
+
+func TestCollector_ConcurrentScrapes(t *testing.T) {
+	// Several Prometheus replicas scraping at once share the cache
+	collector := NewCollector(filepath.Join("test_fixtures", "histogram"), WithLiveness(allAlive), WithConcurrency(4))
+	expected := render(t, collector)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 10 {
+				if got := render(t, collector); got != expected {
+					t.Errorf("got\n%s\nwant\n%s", got, expected)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
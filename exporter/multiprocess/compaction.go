@@ -0,0 +1,251 @@
+package multiprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Compactor keeps counters monotonic across worker churn.
+//
+// When a process exits, its counter, histogram and summary files are
+// eventually removed by the Ruby side, and their values would disappear from
+// the summed totals. The Compactor folds the values of files written by
+// exited processes into an aggregate file owned by the exporter, then
+// removes the original. The aggregate is merged into every Collect, and
+// survives exporter restarts.
+type Compactor struct {
+	path  string
+	mu    sync.Mutex
+	state compactionState
+}
+
+// compactionState is the on-disk format of the aggregate file
+type compactionState struct {
+	// Files lists the basenames of files that have been folded into Entries.
+	// A file stays listed until it no longer exists, so it is never counted twice
+	// even if removing it failed.
+	Files   []string         `json:"files"`
+	Entries []compactedEntry `json:"entries"`
+}
+
+type compactedEntry struct {
+	Type       string            `json:"type"`
+	FamilyName string            `json:"family_name"`
+	MetricName string            `json:"metric_name"`
+	Labels     map[string]string `json:"labels"`
+	Help       string            `json:"help,omitempty"`
+	Value      compactedValue    `json:"value"`
+}
+
+// compactedValue is a value in the aggregate file. JSON has no NaN or
+// infinities, which a counter can hold, so those are written as strings.
+type compactedValue float64
+
+func (v compactedValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+func (v *compactedValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid compacted value %q: %w", s, err)
+		}
+		*v = compactedValue(f)
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*v = compactedValue(f)
+	return nil
+}
+
+// NewCompactor creates a Compactor that persists its aggregate at path,
+// loading any aggregate left by a previous run.
+func NewCompactor(path string) (*Compactor, error) {
+	c := &Compactor{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read compaction file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return nil, fmt.Errorf("could not parse compaction file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// isCompactable reports whether a file holds values that must never go
+// backwards. Gauges are point-in-time values, so they are never compacted.
+func isCompactable(info *FileInfo) bool {
+	switch info.Type {
+	case "counter", "histogram", "summary":
+		return true
+	}
+	return false
+}
+
+// Folded reports whether the file at path has already been folded into the aggregate
+func (c *Compactor) Folded(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Contains(c.state.Files, filepath.Base(path))
+}
+
+// Fold adds entries read from a file written by an exited process to the
+// aggregate, persists it, and removes the file. Folding the same file twice
+// is a no-op, even when a concurrent collection has already folded and
+// removed it and the removal has been pruned. If the aggregate can't be
+// persisted, nothing changes and the caller should keep using the file's
+// entries directly.
+func (c *Compactor) Fold(info *FileInfo, entries []Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	base := filepath.Base(info.Path)
+	if slices.Contains(c.state.Files, base) {
+		return nil
+	}
+	// Files are only removed once folded, under the lock, so a file that is
+	// gone was folded by a collection that read it at the same time as the
+	// caller, or was removed by the client. Either way it mustn't be added.
+	if _, err := os.Stat(info.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	next := compactionState{
+		Files:   append(slices.Clone(c.state.Files), base),
+		Entries: foldEntries(c.state.Entries, entries),
+	}
+	if err := c.write(next); err != nil {
+		return err
+	}
+	c.state = next
+
+	if err := os.Remove(info.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("folded %s but could not remove it: %w", base, err)
+	}
+	return nil
+}
+
+// Prune forgets folded files that no longer exist, given the basenames that do.
+func (c *Compactor) Prune(existing map[string]bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := slices.DeleteFunc(slices.Clone(c.state.Files), func(base string) bool {
+		return !existing[base]
+	})
+	if len(files) == len(c.state.Files) {
+		return nil
+	}
+
+	next := compactionState{Files: files, Entries: c.state.Entries}
+	if err := c.write(next); err != nil {
+		return err
+	}
+	c.state = next
+	return nil
+}
+
+// Entries returns the aggregated values as entries that can be merged with
+// those read from live files.
+func (c *Compactor) Entries() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]Entry, 0, len(c.state.Entries))
+	for _, e := range c.state.Entries {
+		entries = append(entries, Entry{
+			Type:       e.Type,
+			Value:      float64(e.Value),
+			FamilyName: e.FamilyName,
+			MetricName: e.MetricName,
+			labels:     e.Labels,
+			help:       e.Help,
+			compacted:  true,
+		})
+	}
+	return entries
+}
+
+// foldEntries returns a new aggregate with entries summed into it
+func foldEntries(aggregate []compactedEntry, entries []Entry) []compactedEntry {
+	folded := slices.Clone(aggregate)
+	index := make(map[string]int, len(folded))
+	for i, e := range folded {
+		index[e.entry().mergeKey()] = i
+	}
+	for _, entry := range entries {
+		key := entry.mergeKey()
+		if i, ok := index[key]; ok {
+			folded[i].Value += compactedValue(entry.Value)
+			continue
+		}
+		index[key] = len(folded)
+		folded = append(folded, compactedEntry{
+			Type:       entry.Type,
+			FamilyName: entry.FamilyName,
+			MetricName: entry.MetricName,
+			Labels:     entry.labels,
+			Help:       entry.help,
+			Value:      compactedValue(entry.Value),
+		})
+	}
+	return folded
+}
+
+func (e compactedEntry) entry() Entry {
+	return Entry{
+		Type:       e.Type,
+		FamilyName: e.FamilyName,
+		MetricName: e.MetricName,
+		labels:     e.Labels,
+	}
+}
+
+// write atomically replaces the aggregate file with state
+func (c *Compactor) write(state compactionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("could not write compaction file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write compaction file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write compaction file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write compaction file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("could not write compaction file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package multiprocess
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const compactedCounters = `
+# HELP widgets_created_total Multiprocess metric
+# TYPE widgets_created_total counter
+widgets_created_total{type="guinness"} 250
+widgets_created_total{type="murphys"} 61
+widgets_created_total 30
+`
+
+// copyFixtures copies a fixture directory to a temporary directory that the
+// test is free to modify.
+func copyFixtures(t *testing.T, fixture string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files, err := filepath.Glob(filepath.Join("test_fixtures", fixture, "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range files {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(src)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func exited(pids ...string) Liveness {
+	return LivenessFunc(func(pid string) bool {
+		for _, p := range pids {
+			if pid == p {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCollector_Compaction(t *testing.T) {
+	dir := copyFixtures(t, "counter")
+	statePath := filepath.Join(t.TempDir(), "aggregate.json")
+
+	compactor, err := NewCompactor(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector(dir,
+		WithLiveness(exited("process_id_673", "process_id_677")),
+		WithCompactor(compactor),
+	)
+
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(compactedCounters)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+
+	for _, name := range []string{"counter_process_id_673-0.db", "counter_process_id_677-0.db"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed after compaction, got %v", name, err)
+		}
+	}
+
+	// Collecting again must not count the folded values twice
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(compactedCounters)); err != nil {
+		t.Errorf("CollectAndCompare after compaction failed: %v", err)
+	}
+
+	// A restarted exporter picks the aggregate back up
+	restarted, err := NewCompactor(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector = NewCollector(dir, WithLiveness(allAlive), WithCompactor(restarted))
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(compactedCounters)); err != nil {
+		t.Errorf("CollectAndCompare after restart failed: %v", err)
+	}
+}
+
+func TestCollector_CompactionIgnoresGauges(t *testing.T) {
+	dir := copyFixtures(t, "gauge")
+	compactor, err := NewCompactor(filepath.Join(t.TempDir(), "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector(dir, WithLiveness(exited("process_id_59891")), WithCompactor(compactor))
+	testutil.CollectAndCount(collector)
+
+	if _, err := os.Stat(filepath.Join(dir, "gauge_all_process_id_59891-0.db")); err != nil {
+		t.Errorf("expected gauge file to be left alone: %v", err)
+	}
+	if len(compactor.Entries()) != 0 {
+		t.Errorf("expected no compacted entries, got %d", len(compactor.Entries()))
+	}
+}
+
+func TestCollector_CompactionNeedsSharedNamespace(t *testing.T) {
+	// No process in root, as when the exporter can't see the application's
+	// pid namespace
+	root := t.TempDir()
+	for _, shared := range []bool{false, true} {
+		dir := copyFixtures(t, "counter")
+		compactor, err := NewCompactor(filepath.Join(t.TempDir(), "aggregate.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		liveness := NewProcLiveness(root, nil)
+		liveness.SharedNamespace = shared
+		collector := NewCollector(dir, WithLiveness(liveness), WithCompactor(compactor))
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(compactedCounters)); err != nil {
+			t.Errorf("CollectAndCompare failed: %v", err)
+		}
+
+		_, err = os.Stat(filepath.Join(dir, "counter_process_id_673-0.db"))
+		if shared && !os.IsNotExist(err) {
+			t.Errorf("expected the file to be compacted in a shared namespace, got %v", err)
+		}
+		if !shared && err != nil {
+			t.Errorf("expected the file to be left alone without a shared namespace: %v", err)
+		}
+	}
+}
+
+func TestCollector_CompactionWriteFailure(t *testing.T) {
+	dir := copyFixtures(t, "counter")
+	compactor, err := NewCompactor(filepath.Join(t.TempDir(), "missing", "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector(dir, WithLiveness(exited("process_id_673")), WithCompactor(compactor))
+
+	// The aggregate can't be written, so the file must still be counted and kept
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(compactedCounters)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "counter_process_id_673-0.db")); err != nil {
+		t.Errorf("expected file to be kept when the aggregate can't be written: %v", err)
+	}
+}
+
+func TestCompactor_FoldRemovedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter_process_id_1-0.db")
+	writeDB(t, path, testEntry{`["jobs","jobs",[],[]]`, 3})
+	info, err := ParseFilename(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := readEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactor, err := NewCompactor(filepath.Join(t.TempDir(), "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One collection folds and removes the file, another then prunes it, and
+	// a third that read the file before it was removed folds it too late
+	if err := compactor.Fold(info, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactor.Prune(map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactor.Fold(info, entries); err != nil {
+		t.Fatal(err)
+	}
+	if got := compactor.Entries(); len(got) != 1 || got[0].Value != 3 {
+		t.Errorf("expected the file to be counted once, got %v", got)
+	}
+}
+
+func TestCompactor_NonFiniteValues(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "aggregate.json")
+	compactor, err := NewCompactor(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter_process_id_1-0.db")
+	writeDB(t, path,
+		testEntry{`["overflow","overflow",[],[]]`, math.Inf(1)},
+		testEntry{`["undefined","undefined",[],[]]`, math.NaN()},
+	)
+	info, err := ParseFilename(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := readEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compactor.Fold(info, entries); err != nil {
+		t.Fatalf("expected non-finite values to be persisted: %v", err)
+	}
+
+	restarted, err := NewCompactor(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, entry := range restarted.Entries() {
+		values[entry.MetricName] = entry.Value
+	}
+	if !math.IsInf(values["overflow"], 1) || !math.IsNaN(values["undefined"]) {
+		t.Errorf("expected +Inf and NaN to survive a restart, got %v", values)
+	}
+}
+
+func TestCollector_CompactionKeepsChangedBuckets(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "histogram_process_id_1-0.db"),
+		testEntry{`["wait_seconds","wait_seconds_bucket",["le"],["1"]]`, 1},
+		testEntry{`["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, 2},
+		testEntry{`["wait_seconds","wait_seconds_sum",[],[]]`, 3},
+		testEntry{`["wait_seconds","wait_seconds_count",[],[]]`, 2},
+	)
+	writeDB(t, filepath.Join(dir, "histogram_process_id_2-0.db"),
+		testEntry{`["wait_seconds","wait_seconds_bucket",["le"],["0.5"]]`, 1},
+		testEntry{`["wait_seconds","wait_seconds_bucket",["le"],["1"]]`, 1},
+		testEntry{`["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, 1},
+		testEntry{`["wait_seconds","wait_seconds_sum",[],[]]`, 0.25},
+		testEntry{`["wait_seconds","wait_seconds_count",[],[]]`, 1},
+	)
+	compactor, err := NewCompactor(filepath.Join(t.TempDir(), "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector(dir,
+		WithLiveness(exited("process_id_1")),
+		WithCompactor(compactor),
+		WithConflictPolicy(ConflictNewest),
+	)
+
+	// The aggregate's older buckets aren't a conflict the newest files win,
+	// so process_id_1's observations are still counted
+	expected := `
+# HELP wait_seconds Multiprocess metric
+# TYPE wait_seconds histogram
+wait_seconds_bucket{le="0.5"} 1
+wait_seconds_bucket{le="1"} 2
+wait_seconds_bucket{le="+Inf"} 3
+wait_seconds_sum 3.25
+wait_seconds_count 3
+`
+	for range 2 {
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+			t.Errorf("CollectAndCompare failed: %v", err)
+		}
+	}
+}
+
+func TestCollector_CompactionTypeChange(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"), testEntry{`["jobs","jobs",[],[]]`, 3})
+	writeDB(t, filepath.Join(dir, "gauge_all_process_id_2-0.db"), testEntry{`["jobs","jobs",[],[]]`, 1})
+	compactor, err := NewCompactor(filepath.Join(t.TempDir(), "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector(dir, WithLiveness(exited("process_id_1")), WithCompactor(compactor))
+
+	// jobs is now a gauge, so the counter's totals no longer apply
+	expected := `
+# HELP jobs Multiprocess metric
+# TYPE jobs gauge
+jobs{process_id="2"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package multiprocess
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ConflictPolicy decides how a family is served when files disagree about its
+// type, multiprocess mode or histogram buckets, e.g. when a file left over
+// from an older deploy defines it differently.
+type ConflictPolicy string
+
+const (
+	// ConflictNewest serves only the definition from the most recently
+	// modified files
+	ConflictNewest ConflictPolicy = "newest"
+	// ConflictDrop doesn't serve the family at all
+	ConflictDrop ConflictPolicy = "drop"
+	// ConflictSuffix serves each definition under the family name suffixed
+	// with what sets it apart, e.g. jobs_processed_counter and jobs_processed_gauge
+	ConflictSuffix ConflictPolicy = "suffix"
+)
+
+// ParseConflictPolicy returns the policy called name
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictNewest, ConflictDrop, ConflictSuffix:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, expected %s, %s or %s", name, ConflictNewest, ConflictDrop, ConflictSuffix)
+}
+
+// definition is one way a family has been written: its type, the mode of
+// gauges and the bucket bounds of histograms
+type definition struct {
+	typ     string
+	mode    string
+	buckets string
+	newest  float64 // mtime of the most recently modified file with this definition
+}
+
+func (d *definition) key() string {
+	return d.typ + "|" + d.mode + "|" + d.buckets
+}
+
+func (d *definition) String() string {
+	s := d.typ
+	if d.mode != "" {
+		s += "/" + d.mode
+	}
+	if d.buckets != "" {
+		s += " le=" + d.buckets
+	}
+	return s
+}
+
+// resolveConflicts applies the conflict policy to families with more than one
+// definition, returning the entries to serve. Entries of families without a
+// conflict are returned untouched and in order. A type declared in a family's
+// metadata settles conflicts of type before the policy applies.
+//
+// The aggregate of compacted files isn't a definition of its own: it has no
+// modification time or pid, and holds the totals of every layout its files
+// were written with, so the policy would drop it and counters would go
+// backwards. It is served under the family's name alongside whichever
+// definition is, unless that has another type.
+func (c *Collector) resolveConflicts(entries []Entry, metadata map[string]Metadata) []Entry {
+	layouts := bucketLayouts(entries)
+	overridden := make(map[string]bool) // family -> whether its gauge mode is overridden
+	families := make(map[string]map[string]*definition)
+	keys := make([]string, len(entries))
+	compacted := make(map[string]bool) // families with compacted entries
+	for i, entry := range entries {
+		if entry.compacted {
+			compacted[entry.FamilyName] = true
+			continue
+		}
+		def := &definition{typ: entry.Type}
+		switch entry.Type {
+		case "gauge":
+			// Modes don't conflict when an aggregation override replaces them
+			override, ok := overridden[entry.FamilyName]
+			if !ok {
+				_, override = c.aggregator.rule(entry.FamilyName)
+				overridden[entry.FamilyName] = override
+			}
+			if !override {
+				def.mode = entry.MultiprocessMode
+			}
+		case "histogram":
+			def.buckets = layouts[sourceKey(entry)]
+		}
+		keys[i] = def.key()
+
+		defs := families[entry.FamilyName]
+		if defs == nil {
+			defs = make(map[string]*definition)
+			families[entry.FamilyName] = defs
+		}
+		if existing, ok := defs[keys[i]]; ok {
+			def = existing
+		} else {
+			defs[keys[i]] = def
+		}
+		def.newest = max(def.newest, entry.modTime)
+	}
+
+	// family -> definition key -> name to serve it under, or "" to drop it
+	renames := make(map[string]map[string]string)
+	for _, family := range slices.Sorted(maps.Keys(families)) {
+		defs := families[family]
+		if len(defs) <= 1 {
+			continue
+		}
+		kept := c.declaredDefinitions(family, defs, metadata[family].Type)
+		if len(kept) > 1 {
+			renames[family] = c.resolveConflict(family, kept)
+			continue
+		}
+		names := make(map[string]string, 1)
+		for key := range kept {
+			names[key] = family
+		}
+		renames[family] = names
+	}
+
+	// family -> the type served under its name, for families with compacted
+	// entries of another type
+	served := make(map[string]string)
+	for family := range compacted {
+		if typ := servedType(family, families[family], renames[family]); typ != "" {
+			served[family] = typ
+		}
+	}
+	if len(renames) == 0 && len(served) == 0 {
+		return entries
+	}
+
+	resolved := make([]Entry, 0, len(entries))
+	for i, entry := range entries {
+		if entry.compacted {
+			if typ, ok := served[entry.FamilyName]; ok && typ != entry.Type {
+				continue // The family's type has changed, so its old totals no longer apply
+			}
+			resolved = append(resolved, entry)
+			continue
+		}
+		if names, ok := renames[entry.FamilyName]; ok {
+			name := names[keys[i]]
+			if name == "" {
+				continue
+			}
+			entry.MetricName = name + strings.TrimPrefix(entry.MetricName, entry.FamilyName)
+			entry.FamilyName = name
+		}
+		resolved = append(resolved, entry)
+	}
+	return resolved
+}
+
+// servedType returns the type of the definition of family served under its
+// own name, or "" if none is
+func servedType(family string, defs map[string]*definition, names map[string]string) string {
+	for key, def := range defs {
+		if names == nil || names[key] == family {
+			return def.typ
+		}
+	}
+	return ""
+}
+
+// declaredDefinitions returns the definitions of family with the type its
+// metadata declares, when it declares one that any files were written with.
+// Files of other types were written before the family's type was changed,
+// so they are dropped whatever the conflict policy. When that leaves one
+// definition, the conflict is reported here.
+func (c *Collector) declaredDefinitions(family string, defs map[string]*definition, declared string) map[string]*definition {
+	if declared == "" {
+		return defs
+	}
+	kept := make(map[string]*definition, len(defs))
+	for key, def := range defs {
+		if def.typ == declared {
+			kept[key] = def
+		}
+	}
+	if len(kept) == 0 || len(kept) == len(defs) {
+		return defs
+	}
+
+	if len(kept) == 1 {
+		c.metrics.familyConflicts.WithLabelValues(family, "type").Inc()
+		if c.conflictLog.allow(family) {
+			log.Printf("Conflicting type for %s across files: serving %s as declared in its metadata", family, declared)
+		}
+	}
+	return kept
+}
+
+// resolveConflict reports a conflict and decides the name each definition of
+// family is served under
+func (c *Collector) resolveConflict(family string, defs map[string]*definition) map[string]string {
+	sorted := slices.Sorted(maps.Keys(defs))
+	kind, suffixes := conflictSuffixes(sorted, defs)
+	c.metrics.familyConflicts.WithLabelValues(family, kind).Inc()
+
+	names := make(map[string]string, len(defs))
+	var action string
+	switch c.conflicts {
+	case ConflictDrop:
+		action = "dropping the family"
+	case ConflictSuffix:
+		for _, key := range sorted {
+			names[key] = family + "_" + suffixes[key]
+		}
+		action = "serving each under a suffixed name"
+	default:
+		newest := sorted[0]
+		for _, key := range sorted[1:] {
+			if defs[key].newest > defs[newest].newest {
+				newest = key
+			}
+		}
+		names[newest] = family
+		action = fmt.Sprintf("serving %s from the newest files", defs[newest])
+	}
+
+	if c.conflictLog.allow(family) {
+		seen := make([]string, len(sorted))
+		for i, key := range sorted {
+			seen[i] = defs[key].String()
+		}
+		log.Printf("Conflicting %s for %s across files (%s): %s", kind, family, strings.Join(seen, "; "), action)
+	}
+	return names
+}
+
+// conflictSuffixes returns the kind of conflict between definitions, and a
+// suffix for each made of whatever sets it apart from the others: its type,
+// its mode among gauges, or a hash of its bucket bounds among histograms.
+func conflictSuffixes(keys []string, defs map[string]*definition) (string, map[string]string) {
+	types := make(map[string]bool)
+	modes := make(map[string]map[string]bool)   // type -> modes
+	buckets := make(map[string]map[string]bool) // type and mode -> bucket layouts
+	for _, key := range keys {
+		def := defs[key]
+		types[def.typ] = true
+		addTo(modes, def.typ, def.mode)
+		addTo(buckets, def.typ+"|"+def.mode, def.buckets)
+	}
+	byType := len(types) > 1
+	byMode := anyMultiple(modes)
+	byBuckets := anyMultiple(buckets)
+
+	kind := "buckets"
+	switch {
+	case byType:
+		kind = "type"
+	case byMode:
+		kind = "mode"
+	}
+
+	suffixes := make(map[string]string, len(keys))
+	for _, key := range keys {
+		def := defs[key]
+		var parts []string
+		if byType {
+			parts = append(parts, def.typ)
+		}
+		if byMode && def.mode != "" {
+			parts = append(parts, def.mode)
+		}
+		if byBuckets && def.buckets != "" {
+			parts = append(parts, bucketsSuffix(def.buckets))
+		}
+		suffixes[key] = strings.Join(parts, "_")
+	}
+	return kind, suffixes
+}
+
+func addTo(sets map[string]map[string]bool, key, value string) {
+	if sets[key] == nil {
+		sets[key] = make(map[string]bool)
+	}
+	sets[key][value] = true
+}
+
+func anyMultiple(sets map[string]map[string]bool) bool {
+	for _, set := range sets {
+		if len(set) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketsSuffix names a bucket layout. Bounds don't make valid metric names,
+// so they are hashed.
+func bucketsSuffix(buckets string) string {
+	h := fnv.New32a()
+	h.Write([]byte(buckets))
+	return fmt.Sprintf("buckets_%08x", h.Sum32())
+}
+
+// sourceKey identifies the file an entry was read from, closely enough to
+// tell the bucket layouts of different processes apart
+func sourceKey(e Entry) string {
+	return e.FamilyName + "\x00" + e.PID + "\x00" + e.Type + "\x00" + e.MultiprocessMode
+}
+
+// bucketLayouts returns the bucket bounds of each histogram in each source,
+// sorted and formatted so that 1 and 1.0 are the same bound
+func bucketLayouts(entries []Entry) map[string]string {
+	bounds := make(map[string]map[float64]bool)
+	for _, entry := range entries {
+		if entry.compacted || entry.Type != "histogram" || !strings.HasSuffix(entry.MetricName, "_bucket") {
+			continue
+		}
+		bound, err := entry.upperBound()
+		if err != nil {
+			continue
+		}
+		key := sourceKey(entry)
+		if bounds[key] == nil {
+			bounds[key] = make(map[float64]bool)
+		}
+		bounds[key][bound] = true
+	}
+
+	layouts := make(map[string]string, len(bounds))
+	for key, set := range bounds {
+		sorted := slices.Sorted(maps.Keys(set))
+		formatted := make([]string, len(sorted))
+		for i, bound := range sorted {
+			formatted[i] = strconv.FormatFloat(bound, 'g', -1, 64)
+		}
+		layouts[key] = strings.Join(formatted, ",")
+	}
+	return layouts
+}
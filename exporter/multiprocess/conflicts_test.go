@@ -0,0 +1,193 @@
+package multiprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeConflictingFiles writes families defined differently by an older and
+// a newer set of files
+func writeConflictingFiles(t *testing.T, dir string) {
+	t.Helper()
+	older := time.Now().Add(-time.Hour)
+
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"),
+		testEntry{key: `["jobs_processed","jobs_processed",[],[]]`, value: 7},
+		testEntry{key: `["jobs_failed","jobs_failed",[],[]]`, value: 1},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_all_process_id_2-0.db"),
+		testEntry{key: `["jobs_processed","jobs_processed",[],[]]`, value: 5},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_min_process_id_3-0.db"),
+		testEntry{key: `["queue_depth","queue_depth",[],[]]`, value: 2},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_max_process_id_4-0.db"),
+		testEntry{key: `["queue_depth","queue_depth",[],[]]`, value: 4},
+	)
+	writeDB(t, filepath.Join(dir, "histogram_process_id_5-0.db"),
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["1.0"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, value: 2},
+		testEntry{key: `["wait_seconds","wait_seconds_sum",[],[]]`, value: 3},
+		testEntry{key: `["wait_seconds","wait_seconds_count",[],[]]`, value: 2},
+	)
+	writeDB(t, filepath.Join(dir, "histogram_process_id_6-0.db"),
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["0.5"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["1"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_sum",[],[]]`, value: 0.25},
+		testEntry{key: `["wait_seconds","wait_seconds_count",[],[]]`, value: 1},
+	)
+
+	for _, name := range []string{"counter_process_id_1-0.db", "gauge_min_process_id_3-0.db", "histogram_process_id_5-0.db"} {
+		if err := os.Chtimes(filepath.Join(dir, name), older, older); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCollector_ConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy   ConflictPolicy
+		expected string
+	}{
+		{
+			policy: ConflictNewest,
+			expected: `
+# HELP jobs_failed Multiprocess metric
+# TYPE jobs_failed counter
+jobs_failed 1
+# HELP jobs_processed Multiprocess metric
+# TYPE jobs_processed gauge
+jobs_processed{process_id="2"} 5
+# HELP queue_depth Multiprocess metric
+# TYPE queue_depth gauge
+queue_depth 4
+# HELP wait_seconds Multiprocess metric
+# TYPE wait_seconds histogram
+wait_seconds_bucket{le="0.5"} 1
+wait_seconds_bucket{le="1"} 1
+wait_seconds_bucket{le="+Inf"} 1
+wait_seconds_sum 0.25
+wait_seconds_count 1
+`,
+		},
+		{
+			policy: ConflictDrop,
+			expected: `
+# HELP jobs_failed Multiprocess metric
+# TYPE jobs_failed counter
+jobs_failed 1
+`,
+		},
+		{
+			policy: ConflictSuffix,
+			expected: `
+# HELP jobs_failed Multiprocess metric
+# TYPE jobs_failed counter
+jobs_failed 1
+# HELP jobs_processed_counter Multiprocess metric
+# TYPE jobs_processed_counter counter
+jobs_processed_counter 7
+# HELP jobs_processed_gauge Multiprocess metric
+# TYPE jobs_processed_gauge gauge
+jobs_processed_gauge{process_id="2"} 5
+# HELP queue_depth_max Multiprocess metric
+# TYPE queue_depth_max gauge
+queue_depth_max 4
+# HELP queue_depth_min Multiprocess metric
+# TYPE queue_depth_min gauge
+queue_depth_min 2
+# HELP wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + ` Multiprocess metric
+# TYPE wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + ` histogram
+wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + `_bucket{le="0.5"} 1
+wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + `_bucket{le="1"} 1
+wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + `_bucket{le="+Inf"} 1
+wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + `_sum 0.25
+wait_seconds_` + bucketsSuffix("0.5,1,+Inf") + `_count 1
+# HELP wait_seconds_` + bucketsSuffix("1,+Inf") + ` Multiprocess metric
+# TYPE wait_seconds_` + bucketsSuffix("1,+Inf") + ` histogram
+wait_seconds_` + bucketsSuffix("1,+Inf") + `_bucket{le="1"} 1
+wait_seconds_` + bucketsSuffix("1,+Inf") + `_bucket{le="+Inf"} 2
+wait_seconds_` + bucketsSuffix("1,+Inf") + `_sum 3
+wait_seconds_` + bucketsSuffix("1,+Inf") + `_count 2
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			writeConflictingFiles(t, dir)
+
+			metrics := NewMetrics(prometheus.NewRegistry())
+			collector := NewCollector(dir,
+				WithLiveness(allAlive),
+				WithMetrics(metrics),
+				WithConflictPolicy(tt.policy),
+			)
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected)); err != nil {
+				t.Fatalf("CollectAndCompare failed: %v", err)
+			}
+
+			for _, conflict := range [][2]string{
+				{"jobs_processed", "type"},
+				{"queue_depth", "mode"},
+				{"wait_seconds", "buckets"},
+			} {
+				if got := testutil.ToFloat64(metrics.familyConflicts.WithLabelValues(conflict[0], conflict[1])); got != 1 {
+					t.Errorf("expected 1 %s conflict for %s, got %v", conflict[1], conflict[0], got)
+				}
+			}
+			if got := testutil.CollectAndCount(metrics.familyConflicts); got != 3 {
+				t.Errorf("expected 3 conflicts, got %d", got)
+			}
+		})
+	}
+}
+
+func TestCollector_ConflictDeclaredType(t *testing.T) {
+	// The metadata declares jobs_processed a counter, so the gauge files were
+	// left over from before its type changed, whatever the policy
+	for _, policy := range []ConflictPolicy{ConflictNewest, ConflictDrop, ConflictSuffix} {
+		t.Run(string(policy), func(t *testing.T) {
+			dir := t.TempDir()
+			writeConflictingFiles(t, dir)
+			writeMetadata(t, dir, `{"jobs_processed": {"type": "counter", "help": "Jobs processed"}}`)
+
+			metrics := NewMetrics(prometheus.NewRegistry())
+			collector := NewCollector(dir,
+				WithLiveness(allAlive),
+				WithMetrics(metrics),
+				WithConflictPolicy(policy),
+			)
+			expected := `
+# HELP jobs_processed Jobs processed
+# TYPE jobs_processed counter
+jobs_processed 7
+`
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "jobs_processed"); err != nil {
+				t.Fatalf("CollectAndCompare failed: %v", err)
+			}
+			if got := testutil.ToFloat64(metrics.familyConflicts.WithLabelValues("jobs_processed", "type")); got != 1 {
+				t.Errorf("expected the type conflict to be counted, got %v", got)
+			}
+		})
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, name := range []string{"newest", "drop", "suffix"} {
+		if policy, err := ParseConflictPolicy(name); err != nil || string(policy) != name {
+			t.Errorf("ParseConflictPolicy(%q) = %q, %v", name, policy, err)
+		}
+	}
+	if _, err := ParseConflictPolicy("oldest"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
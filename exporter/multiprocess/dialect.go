@@ -0,0 +1,291 @@
+package multiprocess
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the files written by one client library. The binary
+// layout is shared by prometheus-client-mmap and Python's prometheus_client,
+// but they differ in how files are named, how entry keys are encoded, what
+// follows each key and what histogram buckets count.
+type Dialect struct {
+	Name string
+
+	parseFilename func(path string) (*FileInfo, error)
+	decodeKey     func(parts []any) (entryKey, error)
+	// valueSizes are the bytes following each key, tried in order until one
+	// decodes the whole file
+	valueSizes []int
+	// cumulativeBuckets is false when each histogram bucket only counts the
+	// observations that fell into it, and no _count is written
+	cumulativeBuckets bool
+}
+
+// entryKey is the identity of an entry, decoded from its JSON key
+type entryKey struct {
+	familyName string
+	metricName string
+	labels     map[string]string
+	help       string
+}
+
+var (
+	// RubyDialect reads files written by prometheus-client-mmap, named
+	// <type>_<pid>-<n>.db or gauge_<mode>_<pid>-<n>.db, with keys of
+	// [family, metric, [label names], [label values]] followed by a value.
+	RubyDialect = &Dialect{
+		Name:              "ruby",
+		parseFilename:     parseRubyFilename,
+		decodeKey:         decodeRubyKey,
+		valueSizes:        []int{8},
+		cumulativeBuckets: true,
+	}
+
+	// PythonDialect reads files written by Python's prometheus_client, named
+	// <type>_<pid>.db or gauge_<mode>_<pid>.db, with keys of
+	// [family, metric, {labels}, help]. Newer versions write a timestamp after
+	// each value, older ones just the value.
+	PythonDialect = &Dialect{
+		Name:              "python",
+		parseFilename:     parsePythonFilename,
+		decodeKey:         decodePythonKey,
+		valueSizes:        []int{16, 8},
+		cumulativeBuckets: false,
+	}
+)
+
+// dialects are tried in order when auto-detecting. Python filenames are the
+// stricter format, so they are checked first.
+var dialects = []*Dialect{PythonDialect, RubyDialect}
+
+// DialectByName returns the dialect called name
+func DialectByName(name string) (*Dialect, error) {
+	for _, d := range dialects {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown dialect %q", name)
+}
+
+// layout is a dialect together with one of its value sizes: all that is
+// needed to decode a file's entries.
+type layout struct {
+	dialect   *Dialect
+	valueSize int
+}
+
+// parseFilenameAs extracts metadata from the filename using the first of
+// candidates that understands it. The contents are decoded with that dialect
+// first, falling back to the others.
+func parseFilenameAs(path string, candidates []*Dialect) (*FileInfo, error) {
+	var firstErr error
+	for i, d := range candidates {
+		info, err := d.parseFilename(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		info.dialects = append([]*Dialect{d}, slices.Delete(slices.Clone(candidates), i, i+1)...)
+		return info, nil
+	}
+	return nil, firstErr
+}
+
+// parseRubyFilename parses the names written by prometheus-client-mmap.
+// Only gauges carry a mode segment, and every part may have a -N suffix.
+func parseRubyFilename(path string) (*FileInfo, error) {
+	basename := filepath.Base(path)
+	name := strings.TrimSuffix(basename, ".db")
+
+	parts := strings.Split(name, "_")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%w: %s", ErrFilenameFormat, basename)
+	}
+
+	// Remove trailing -number from parts
+	for i, part := range parts {
+		if idx := strings.LastIndex(part, "-"); idx > 0 {
+			parts[i] = part[:idx]
+		}
+	}
+
+	info := &FileInfo{
+		Path: path,
+		Type: parts[0],
+	}
+
+	// Only gauges carry a multiprocess mode: gauge_<mode>_<pid> vs <type>_<pid>
+	pidParts := parts[1:]
+	if info.Type == "gauge" {
+		info.MultiprocessMode = parts[1]
+		pidParts = parts[2:]
+	}
+	info.PID = strings.Join(pidParts, "_")
+	if info.Type == "" || info.PID == "" || (info.Type == "gauge" && info.MultiprocessMode == "") {
+		return nil, fmt.Errorf("%w: %s", ErrFilenameFormat, basename)
+	}
+
+	return info, nil
+}
+
+// parsePythonFilename parses the names written by prometheus_client. The pid
+// is a single segment, as prometheus_client itself splits names on _.
+func parsePythonFilename(path string) (*FileInfo, error) {
+	basename := filepath.Base(path)
+	name := strings.TrimSuffix(basename, ".db")
+
+	parts := strings.Split(name, "_")
+	info := &FileInfo{
+		Path: path,
+		Type: parts[0],
+	}
+	switch {
+	case info.Type == "gauge" && len(parts) == 3:
+		info.MultiprocessMode = parts[1]
+		info.PID = parts[2]
+	case info.Type != "gauge" && len(parts) == 2:
+		info.PID = parts[1]
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFilenameFormat, basename)
+	}
+	if info.Type == "" || info.PID == "" || strings.Contains(info.PID, "-") || (info.Type == "gauge" && info.MultiprocessMode == "") {
+		return nil, fmt.Errorf("%w: %s", ErrFilenameFormat, basename)
+	}
+	return info, nil
+}
+
+func decodeRubyKey(parts []any) (entryKey, error) {
+	labelNames, ok := parts[2].([]any)
+	if !ok {
+		return entryKey{}, fmt.Errorf("expected label names to be an array")
+	}
+	labelValues, _ := parts[3].([]any)
+
+	key := keyNames(parts)
+	for i, name := range labelNames {
+		if i < len(labelValues) {
+			nameStr, _ := name.(string)
+			key.labels[nameStr] = labelValue(labelValues[i])
+		}
+	}
+	return key, nil
+}
+
+func decodePythonKey(parts []any) (entryKey, error) {
+	labels, ok := parts[2].(map[string]any)
+	if !ok {
+		return entryKey{}, fmt.Errorf("expected labels to be an object")
+	}
+
+	key := keyNames(parts)
+	for name, value := range labels {
+		key.labels[name] = labelValue(value)
+	}
+	key.help, _ = parts[3].(string)
+	return key, nil
+}
+
+// validate rejects keys that decoded without the names every entry needs, or
+// with a bound that can't order histogram buckets or summary quantiles
+func (k entryKey) validate() error {
+	if k.familyName == "" || k.metricName == "" {
+		return fmt.Errorf("empty family or metric name")
+	}
+	for _, name := range []string{"le", "quantile"} {
+		if bound, ok := k.labels[name]; ok {
+			if f, err := strconv.ParseFloat(bound, 64); err == nil && math.IsNaN(f) {
+				return fmt.Errorf("%s is NaN", name)
+			}
+		}
+	}
+	return nil
+}
+
+// keyNames returns a key with the family and metric names common to every dialect
+func keyNames(parts []any) entryKey {
+	familyName, _ := parts[0].(string)
+	metricName, _ := parts[1].(string)
+	return entryKey{
+		familyName: familyName,
+		metricName: metricName,
+		labels:     make(map[string]string),
+	}
+}
+
+func labelValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// accumulateBuckets converts histograms whose buckets only count their own
+// observations into cumulative buckets, adding the _count they imply.
+func accumulateBuckets(entries []Entry) []Entry {
+	var series []string
+	buckets := make(map[string][]int) // series -> indexes of its buckets
+	counted := make(map[string]bool)
+	for i, entry := range entries {
+		if entry.Type != "histogram" {
+			continue
+		}
+		key := entry.groupKey()
+		switch {
+		case strings.HasSuffix(entry.MetricName, "_bucket"):
+			if _, ok := buckets[key]; !ok {
+				series = append(series, key)
+			}
+			buckets[key] = append(buckets[key], i)
+		case strings.HasSuffix(entry.MetricName, "_count"):
+			counted[key] = true
+		}
+	}
+
+	for _, key := range series {
+		indexes := buckets[key]
+		slices.SortFunc(indexes, func(a, b int) int {
+			// Invalid bounds fail later, when the histogram is built
+			boundA, _ := entries[a].upperBound()
+			boundB, _ := entries[b].upperBound()
+			switch {
+			case boundA < boundB:
+				return -1
+			case boundA > boundB:
+				return 1
+			}
+			return 0
+		})
+
+		var total float64
+		for _, i := range indexes {
+			total += entries[i].Value
+			entries[i].Value = total
+		}
+
+		if !counted[key] {
+			count := entries[indexes[0]]
+			count.MetricName = count.FamilyName + "_count"
+			count.labels = make(map[string]string, len(count.labels))
+			for name, value := range entries[indexes[0]].labels {
+				if name != "le" {
+					count.labels[name] = value
+				}
+			}
+			count.Value = total
+			entries = append(entries, count)
+		}
+	}
+	return entries
+}
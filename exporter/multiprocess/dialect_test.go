@@ -0,0 +1,84 @@
+package multiprocess
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector_PythonValueOnlyLayout(t *testing.T) {
+	// Versions of prometheus_client before timestamps were added write just
+	// the value after each key, like the Ruby client.
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "counter_11.db"),
+		testEntry{key: `["jobs", "jobs_total", {"queue": "default"}, "Jobs run"]`, value: 3},
+	)
+	writeDB(t, filepath.Join(dir, "histogram_11.db"),
+		testEntry{key: `["wait_seconds", "wait_seconds_sum", {}, "Time waited"]`, value: 2.5},
+		testEntry{key: `["wait_seconds", "wait_seconds_bucket", {"le": "1.0"}, "Time waited"]`, value: 1},
+		testEntry{key: `["wait_seconds", "wait_seconds_bucket", {"le": "+Inf"}, "Time waited"]`, value: 1},
+	)
+	writeDB(t, filepath.Join(dir, "histogram_12.db"),
+		testEntry{key: `["wait_seconds", "wait_seconds_sum", {}, "Time waited"]`, value: 0.5},
+		testEntry{key: `["wait_seconds", "wait_seconds_bucket", {"le": "+Inf"}, "Time waited"]`, value: 0},
+		testEntry{key: `["wait_seconds", "wait_seconds_bucket", {"le": "1.0"}, "Time waited"]`, value: 1},
+	)
+
+	expected := `
+# HELP jobs_total Jobs run
+# TYPE jobs_total counter
+jobs_total{queue="default"} 3
+# HELP wait_seconds Time waited
+# TYPE wait_seconds histogram
+wait_seconds_bucket{le="1"} 2
+wait_seconds_bucket{le="+Inf"} 3
+wait_seconds_sum 3
+wait_seconds_count 3
+`
+	collector := NewCollector(dir, WithLiveness(allAlive))
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
+
+func TestCollector_WithDialect(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect *Dialect
+		fixture string
+		want    int
+	}{
+		{name: "ruby files as ruby", dialect: RubyDialect, fixture: "counter", want: 3},
+		{name: "ruby files as python", dialect: PythonDialect, fixture: "counter", want: 0},
+		{name: "python files as python", dialect: PythonDialect, fixture: "python", want: 12},
+		{name: "python files as ruby", dialect: RubyDialect, fixture: "python", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := NewCollector(fixtureDir(t, tt.fixture),
+				WithLiveness(allAlive),
+				WithDialect(tt.dialect),
+			)
+			if got := testutil.CollectAndCount(collector); got != tt.want {
+				t.Errorf("got %d metrics, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialectByName(t *testing.T) {
+	for _, name := range []string{"ruby", "python"} {
+		dialect, err := DialectByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dialect.Name != name {
+			t.Errorf("got %q, want %q", dialect.Name, name)
+		}
+	}
+	if _, err := DialectByName("perl"); err == nil {
+		t.Error("expected an error for an unknown dialect")
+	}
+}
@@ -0,0 +1,34 @@
+package multiprocess
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors describing why a file could not be read. They are stable, so
+// callers can classify failures with errors.Is.
+var (
+	// ErrFilenameFormat means the filename doesn't follow any dialect's
+	// naming convention, so the type, mode and pid of its entries are unknown
+	ErrFilenameFormat = errors.New("invalid filename format")
+	// ErrTruncated means the file is shorter than its header or an entry says
+	ErrTruncated = errors.New("truncated file")
+	// ErrCorruptedEntry means an entry's length or value is inconsistent with the file
+	ErrCorruptedEntry = errors.New("corrupted entry")
+	// ErrInvalidKey means an entry's key is not the JSON its dialect writes
+	ErrInvalidKey = errors.New("invalid JSON key")
+)
+
+// EntryError is an error decoding the entry at Offset bytes into a file
+type EntryError struct {
+	Offset int
+	Err    error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("entry at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,169 @@
+package multiprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestCollector_Expiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)}
+	dir := t.TempDir()
+	setMtime := func(name string, mtime time.Time) {
+		t.Helper()
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A file from the previous release, one from the current release, and
+	// one whose writer only adds series now and again
+	writeDB(t, filepath.Join(dir, "gauge_all_process_id_1-0.db"),
+		testEntry{key: `["jobs","jobs",[],[]]`, value: 1},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_all_process_id_2-0.db"),
+		testEntry{key: `["jobs","jobs",[],[]]`, value: 2},
+	)
+	writeDB(t, filepath.Join(dir, "counter_process_id_3-0.db"),
+		testEntry{key: `["jobs_done","jobs_done",[],[]]`, value: 1},
+	)
+	setMtime("gauge_all_process_id_1-0.db", clock.Now().Add(-2*time.Hour))
+	setMtime("gauge_all_process_id_2-0.db", clock.Now().Add(-10*time.Minute))
+	setMtime("counter_process_id_3-0.db", clock.Now().Add(-2*time.Hour))
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewCollector(dir,
+		WithLiveness(LivenessFunc(func(pid string) bool { return pid == "process_id_3" })),
+		WithMetrics(metrics),
+		WithExpiry(time.Hour, 3*time.Hour),
+	)
+	collector.now = clock.Now
+
+	check := func(expected string, expired, deleted float64) {
+		t.Helper()
+		if expected == "" {
+			if n := testutil.CollectAndCount(collector); n != 0 {
+				t.Errorf("expected no metrics, got %d", n)
+			}
+		} else if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+			t.Errorf("CollectAndCompare failed: %v", err)
+		}
+		if got := testutil.ToFloat64(metrics.filesExpired); got != expired {
+			t.Errorf("expected %v files expired, got %v", expired, got)
+		}
+		if got := testutil.ToFloat64(metrics.filesDeleted); got != deleted {
+			t.Errorf("expected %v files deleted, got %v", deleted, got)
+		}
+	}
+
+	// The running process's file is served however old it is
+	check(`
+# HELP jobs Multiprocess metric
+# TYPE jobs gauge
+jobs{process_id="2"} 2
+# HELP jobs_done Multiprocess metric
+# TYPE jobs_done counter
+jobs_done 1
+`, 1, 0)
+
+	// Growing the used header counts as a write, even if the mtime doesn't move
+	appendDB(t, filepath.Join(dir, "gauge_all_process_id_2-0.db"),
+		testEntry{key: `["jobs_failed","jobs_failed",[],[]]`, value: 1},
+	)
+	setMtime("gauge_all_process_id_2-0.db", clock.Now().Add(-2*time.Hour))
+	clock.Advance(30 * time.Minute)
+	check(`
+# HELP jobs Multiprocess metric
+# TYPE jobs gauge
+jobs{process_id="2"} 2
+# HELP jobs_done Multiprocess metric
+# TYPE jobs_done counter
+jobs_done 1
+# HELP jobs_failed Multiprocess metric
+# TYPE jobs_failed gauge
+jobs_failed{process_id="2"} 1
+`, 2, 0)
+
+	// The exited processes' files have expired, and the previous release's
+	// file is past the grace period
+	clock.Advance(2 * time.Hour)
+	check(`
+# HELP jobs_done Multiprocess metric
+# TYPE jobs_done counter
+jobs_done 1
+`, 4, 1)
+	if _, err := os.Stat(filepath.Join(dir, "gauge_all_process_id_1-0.db")); !os.IsNotExist(err) {
+		t.Errorf("expected the previous release's file to be deleted, got %v", err)
+	}
+
+	// Files are only deleted once their process has exited
+	clock.Advance(time.Hour)
+	check(`
+# HELP jobs_done Multiprocess metric
+# TYPE jobs_done counter
+jobs_done 1
+`, 5, 2)
+	if _, err := os.Stat(filepath.Join(dir, "gauge_all_process_id_2-0.db")); !os.IsNotExist(err) {
+		t.Errorf("expected the exited process's file to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "counter_process_id_3-0.db")); err != nil {
+		t.Errorf("expected the running process's file to be kept, got %v", err)
+	}
+}
+
+func TestCollector_ExpiryUncheckedPIDs(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter_worker_id_1-0.db")
+	writeDB(t, path, testEntry{key: `["jobs_done","jobs_done",[],[]]`, value: 1})
+	if err := os.Chtimes(path, clock.Now().Add(-2*time.Hour), clock.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Worker slots can't be checked, so they expire by age alone, but are
+	// never deleted
+	collector := NewCollector(dir,
+		WithLiveness(NewProcLiveness(t.TempDir(), nil)),
+		WithExpiry(time.Hour, time.Hour),
+	)
+	collector.now = clock.Now
+	if n := testutil.CollectAndCount(collector); n != 0 {
+		t.Errorf("expected no metrics, got %d", n)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the file to be kept, got %v", err)
+	}
+}
+
+func TestCollector_NoExpiryByDefault(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "gauge_all_process_id_1-0.db"),
+		testEntry{key: `["jobs","jobs",[],[]]`, value: 1},
+	)
+	old := time.Now().Add(-365 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "gauge_all_process_id_1-0.db"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := NewCollector(dir, WithLiveness(allAlive))
+	if n := testutil.CollectAndCount(collector); n != 1 {
+		t.Errorf("expected 1 metric, got %d", n)
+	}
+}
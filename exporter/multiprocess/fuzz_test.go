@@ -0,0 +1,101 @@
+package multiprocess
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/errm/promenade/exporter/multiprocess/writer"
+)
+
+// fixtureFiles returns every fixture file, to seed the corpus with
+func fixtureFiles(f *testing.F) []string {
+	files, err := filepath.Glob(filepath.Join("test_fixtures", "*", "*.db"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	return files
+}
+
+func FuzzParseEntries(f *testing.F) {
+	for _, file := range fixtureFiles(f) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		// Only the used part matters, and shorter seeds mutate faster
+		if used, err := usedBytes(data, len(data)); err == nil {
+			data = data[:used]
+		}
+		f.Add(filepath.Base(file), data)
+	}
+	data, err := writer.Encode(
+		writer.Entry{Key: writer.Key{Family: "latency", Metric: "latency_bucket", Labels: []writer.Label{{Name: "le", Value: "0.5"}}}, Value: 1},
+		writer.Entry{Key: writer.Key{Family: "latency", Metric: "latency_bucket", Labels: []writer.Label{{Name: "le", Value: "NaN"}}}, Value: 2},
+		writer.Entry{Key: writer.Key{Family: "latency", Metric: "latency_count"}, Value: 2},
+	)
+	if err != nil {
+		f.Fatal(err)
+	}
+	used, err := usedBytes(data, len(data))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add("histogram_process_id_1-0.db", data[:used])
+
+	f.Fuzz(func(t *testing.T, name string, data []byte) {
+		info, err := ParseFilename(name)
+		if err != nil {
+			return
+		}
+		info.Data = data
+		entries, err := parseEntries(info)
+
+		end := headerSize
+		for _, entry := range entries {
+			if entry.FamilyName == "" || entry.MetricName == "" {
+				t.Errorf("entry at %d has an empty name: %+v", entry.offset, entry)
+			}
+			if entry.offset < end || entry.valueOffset+8 > len(data) {
+				t.Errorf("entry at %d overlaps the previous one or overruns the file", entry.offset)
+			}
+			end = entry.valueOffset + 8
+			for _, name := range []string{"le", "quantile"} {
+				if bound, err := strconv.ParseFloat(entry.labels[name], 64); err == nil && math.IsNaN(bound) {
+					t.Errorf("entry at %d has a NaN %s", entry.offset, name)
+				}
+			}
+		}
+		if err != nil && failureReason(err) == "read" {
+			t.Errorf("unclassified error: %v", err)
+		}
+	})
+}
+
+func FuzzParseFilename(f *testing.F) {
+	for _, file := range fixtureFiles(f) {
+		f.Add(filepath.Base(file))
+	}
+	for _, name := range []string{"counter_.db", "gauge_max.db", "_1-0.db", "gauge__1.db", "histogram_1-0-0.db"} {
+		f.Add(name)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		info, err := ParseFilename(name)
+		if err != nil {
+			if !errors.Is(err, ErrFilenameFormat) {
+				t.Errorf("unclassified error for %q: %v", name, err)
+			}
+			return
+		}
+		if info.Type == "" || info.PID == "" {
+			t.Errorf("%q parsed without a type or pid: %+v", name, info)
+		}
+		if (info.Type == "gauge") != (info.MultiprocessMode != "") {
+			t.Errorf("%q parsed with mode %q for a %s", name, info.MultiprocessMode, info.Type)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package multiprocess
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+var (
+	// errBucketsNotMonotonic describes why a merged histogram could not be served
+	errBucketsNotMonotonic = errors.New("cumulative buckets decrease")
+	// errCountMismatch describes a histogram served with its +Inf bucket in
+	// place of a count that differed from it
+	errCountMismatch = errors.New("count differs from the +Inf bucket")
+)
+
+// invalidHistogramReason classifies an error from building a histogram for
+// the reason label, returning "" for errors that aren't about its values
+func invalidHistogramReason(err error) string {
+	switch {
+	case errors.Is(err, errBucketsNotMonotonic):
+		return "not_monotonic"
+	case errors.Is(err, errCountMismatch):
+		return "count_mismatch"
+	}
+	return ""
+}
+
+// validateBuckets checks that cumulative bucket counts never decrease, and
+// returns the count to serve with them. Clients update buckets and the count
+// with separate writes, so a histogram read between them has a count that
+// differs from its +Inf bucket. The +Inf bucket, if there is one, is served
+// as the count, as it is the one the other buckets are consistent with, and
+// the difference is returned as errCountMismatch along with it. Without a
+// +Inf bucket count is served as one, so it mustn't be below the last bucket.
+func validateBuckets(buckets map[float64]uint64, count uint64) (uint64, error) {
+	var previous uint64
+	for _, bound := range slices.Sorted(maps.Keys(buckets)) {
+		value := buckets[bound]
+		if value < previous {
+			return 0, fmt.Errorf("%w: %d at le=%g after %d", errBucketsNotMonotonic, value, bound, previous)
+		}
+		previous = value
+	}
+	if inf, ok := buckets[math.Inf(1)]; ok {
+		if count != inf {
+			return inf, fmt.Errorf("%w: count %d, +Inf %d", errCountMismatch, count, inf)
+		}
+		return inf, nil
+	}
+	if count < previous {
+		return 0, fmt.Errorf("%w: count %d below the last bucket %d", errBucketsNotMonotonic, count, previous)
+	}
+	return count, nil
+}
+
+// reconcileBuckets puts the histograms of families written with different
+// bucket layouts onto the union of their bounds, before they are merged.
+// Each process's cumulative count at a bound it doesn't have is taken from
+// its largest bound below it: the observations it knows are under the bound.
+// This undercounts the new buckets, but keeps every merged histogram monotonic
+// with +Inf equal to the total count.
+func (c *Collector) reconcileBuckets(entries []Entry) []Entry {
+	if !c.reconcile {
+		return entries
+	}
+
+	spellings := make(map[string]map[float64]string) // family -> bound -> le as first written
+	sources := make(map[string]map[string]int)       // family -> source -> number of bounds
+	series := make(map[string][]int)                 // source and labels -> bucket entries
+	var seriesKeys []string
+	for i, entry := range entries {
+		if entry.Type != "histogram" || !strings.HasSuffix(entry.MetricName, "_bucket") {
+			continue
+		}
+		bound, err := entry.upperBound()
+		if err != nil {
+			continue // Reported when the histogram is built
+		}
+		family := entry.FamilyName
+		if spellings[family] == nil {
+			spellings[family] = make(map[float64]string)
+		}
+		if _, ok := spellings[family][bound]; !ok {
+			spellings[family][bound] = entry.labels["le"]
+		}
+		source := sourceKey(entry)
+		if sources[family] == nil {
+			sources[family] = make(map[string]int)
+		}
+
+		key := source + "\x00" + entry.groupKey()
+		if _, ok := series[key]; !ok {
+			seriesKeys = append(seriesKeys, key)
+		}
+		series[key] = append(series[key], i)
+		sources[family][source] = max(sources[family][source], len(series[key]))
+	}
+
+	// Only families whose sources disagree need reconciling
+	mismatched := make(map[string]bool)
+	for family, bounds := range spellings {
+		for _, own := range sources[family] {
+			if own != len(bounds) {
+				mismatched[family] = true
+				break
+			}
+		}
+	}
+	if len(mismatched) == 0 {
+		return entries
+	}
+	for _, family := range slices.Sorted(maps.Keys(mismatched)) {
+		c.metrics.histogramsReconciled.WithLabelValues(family).Inc()
+	}
+
+	for _, key := range seriesKeys {
+		indexes := series[key]
+		family := entries[indexes[0]].FamilyName
+		if !mismatched[family] {
+			continue
+		}
+
+		own := make(map[float64]Entry, len(indexes))
+		for _, i := range indexes {
+			bound, _ := entries[i].upperBound()
+			own[bound] = entries[i]
+		}
+		ownBounds := slices.Sorted(maps.Keys(own))
+
+		for _, bound := range slices.Sorted(maps.Keys(spellings[family])) {
+			if _, ok := own[bound]; ok {
+				continue
+			}
+			bucket := entries[indexes[0]]
+			bucket.labels = maps.Clone(bucket.labels)
+			bucket.labels["le"] = spellings[family][bound]
+			bucket.Value = 0
+			if below := lastBelow(ownBounds, bound); below >= 0 {
+				bucket.Value = own[ownBounds[below]].Value
+			}
+			entries = append(entries, bucket)
+		}
+	}
+	return entries
+}
+
+// lastBelow returns the index of the largest of sorted below bound, or -1
+func lastBelow(sorted []float64, bound float64) int {
+	i, _ := slices.BinarySearch(sorted, bound)
+	return i - 1
+}
@@ -0,0 +1,139 @@
+package multiprocess
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector_ReconcileBuckets(t *testing.T) {
+	dir := t.TempDir()
+	// An older release with the default buckets, and a newer one that added 0.5
+	writeDB(t, filepath.Join(dir, "histogram_process_id_1-0.db"),
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["1.0"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, value: 2},
+		testEntry{key: `["wait_seconds","wait_seconds_sum",[],[]]`, value: 3},
+		testEntry{key: `["wait_seconds","wait_seconds_count",[],[]]`, value: 2},
+	)
+	writeDB(t, filepath.Join(dir, "histogram_process_id_2-0.db"),
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["0.5"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["1"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, value: 1},
+		testEntry{key: `["wait_seconds","wait_seconds_sum",[],[]]`, value: 0.25},
+		testEntry{key: `["wait_seconds","wait_seconds_count",[],[]]`, value: 1},
+	)
+
+	// The older process's observation under 1 can't be placed under 0.5
+	expected := `
+# HELP wait_seconds Multiprocess metric
+# TYPE wait_seconds histogram
+wait_seconds_bucket{le="0.5"} 1
+wait_seconds_bucket{le="1"} 2
+wait_seconds_bucket{le="+Inf"} 3
+wait_seconds_sum 3.25
+wait_seconds_count 3
+`
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewCollector(dir,
+		WithLiveness(allAlive),
+		WithMetrics(metrics),
+		WithBucketReconciliation(),
+	)
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatalf("CollectAndCompare failed: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.histogramsReconciled.WithLabelValues("wait_seconds")); got != 1 {
+		t.Errorf("expected wait_seconds to be reconciled once, got %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.familyConflicts); got != 0 {
+		t.Errorf("expected reconciled layouts not to be conflicts, got %d", got)
+	}
+}
+
+func TestCollector_InvalidHistograms(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "histogram_process_id_1-0.db"),
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["1.0"]]`, value: 3},
+		testEntry{key: `["wait_seconds","wait_seconds_bucket",["le"],["+Inf"]]`, value: 2},
+		testEntry{key: `["wait_seconds","wait_seconds_sum",[],[]]`, value: 3},
+		testEntry{key: `["wait_seconds","wait_seconds_count",[],[]]`, value: 2},
+		testEntry{key: `["run_seconds","run_seconds_bucket",["le"],["1.0"]]`, value: 1},
+		testEntry{key: `["run_seconds","run_seconds_bucket",["le"],["+Inf"]]`, value: 2},
+		testEntry{key: `["run_seconds","run_seconds_sum",[],[]]`, value: 3},
+		testEntry{key: `["run_seconds","run_seconds_count",[],[]]`, value: 4},
+		testEntry{key: `["jobs","jobs_bucket",["le"],["1.0"]]`, value: 1},
+		testEntry{key: `["jobs","jobs_bucket",["le"],["+Inf"]]`, value: 1},
+		testEntry{key: `["jobs","jobs_sum",[],[]]`, value: 0.5},
+		testEntry{key: `["jobs","jobs_count",[],[]]`, value: 1},
+	)
+
+	// run_seconds was read while an observation was being written, after its
+	// count was incremented but before its +Inf bucket was
+	expected := `
+# HELP jobs Multiprocess metric
+# TYPE jobs histogram
+jobs_bucket{le="1"} 1
+jobs_bucket{le="+Inf"} 1
+jobs_sum 0.5
+jobs_count 1
+# HELP run_seconds Multiprocess metric
+# TYPE run_seconds histogram
+run_seconds_bucket{le="1"} 1
+run_seconds_bucket{le="+Inf"} 2
+run_seconds_sum 3
+run_seconds_count 2
+`
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewCollector(dir, WithLiveness(allAlive), WithMetrics(metrics))
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatalf("CollectAndCompare failed: %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.invalidHistograms.WithLabelValues("wait_seconds", "not_monotonic")); got != 1 {
+		t.Errorf("expected wait_seconds to be skipped as not_monotonic, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.invalidHistograms.WithLabelValues("run_seconds", "count_mismatch")); got != 1 {
+		t.Errorf("expected run_seconds to be counted as count_mismatch, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.invalidHistograms.WithLabelValues("jobs", "count_mismatch")); got != 0 {
+		t.Errorf("expected jobs not to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.invalidMetrics); got != 1 {
+		t.Errorf("expected 1 invalid metric, got %v", got)
+	}
+}
+
+func TestValidateBuckets(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name    string
+		buckets map[float64]uint64
+		count   uint64
+		served  uint64
+		want    error
+	}{
+		{name: "valid", buckets: map[float64]uint64{0.5: 1, 1: 2, inf: 3}, count: 3, served: 3},
+		{name: "no buckets", buckets: map[float64]uint64{}, count: 3, served: 3},
+		{name: "count as +Inf", buckets: map[float64]uint64{0.5: 1, 1: 2}, count: 2, served: 2},
+		{name: "decreasing", buckets: map[float64]uint64{0.5: 2, 1: 1, inf: 2}, count: 2, want: errBucketsNotMonotonic},
+		{name: "count written before +Inf", buckets: map[float64]uint64{1: 2, inf: 3}, count: 4, served: 3, want: errCountMismatch},
+		{name: "count written after +Inf", buckets: map[float64]uint64{1: 2, inf: 3}, count: 2, served: 3, want: errCountMismatch},
+		{name: "count below last bucket", buckets: map[float64]uint64{1: 2}, count: 1, want: errBucketsNotMonotonic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served, err := validateBuckets(tt.buckets, tt.count)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+			if served != tt.served {
+				t.Errorf("expected count %d to be served, got %d", tt.served, served)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package multiprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats for Inspect
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// inspectedEntry is a raw entry as it is stored in a file, before merging
+type inspectedEntry struct {
+	File       string            `json:"file"`
+	Offset     int               `json:"offset"`
+	Type       string            `json:"type"`
+	Mode       string            `json:"mode,omitempty"`
+	PID        string            `json:"pid"`
+	FamilyName string            `json:"family"`
+	MetricName string            `json:"metric"`
+	Labels     map[string]string `json:"labels"`
+	Value      any               `json:"value"`
+}
+
+// Inspect writes every raw entry in path, which may be a .db file or a
+// directory of them, as a table or as one JSON object per line. Files that
+// can't be parsed, and each corrupted entry, are reported in the returned
+// error after the rest are written.
+func Inspect(w io.Writer, path, format string) error {
+	if format != FormatTable && format != FormatJSON {
+		return fmt.Errorf("unknown format %q, expected %s or %s", format, FormatTable, FormatJSON)
+	}
+
+	files, err := dbFiles(path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		errs []error
+		out  func(inspectedEntry) error
+	)
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		out = func(e inspectedEntry) error { return enc.Encode(e) }
+	default:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "FILE\tOFFSET\tTYPE\tMODE\tPID\tFAMILY\tMETRIC\tLABELS\tVALUE")
+		out = func(e inspectedEntry) error {
+			_, err := fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%v\n",
+				e.File, e.Offset, e.Type, e.Mode, e.PID, e.FamilyName, e.MetricName, formatLabels(e.Labels), e.Value)
+			return err
+		}
+	}
+
+	for _, file := range files {
+		entries, skipped, err := readEntries(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(file), err))
+			continue
+		}
+		for _, err := range skipped {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(file), err))
+		}
+		for _, entry := range entries {
+			if err := out(inspect(file, entry)); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func inspect(path string, entry Entry) inspectedEntry {
+	var value any = entry.Value
+	if math.IsNaN(entry.Value) || math.IsInf(entry.Value, 0) {
+		// JSON has no representation for these
+		value = strconv.FormatFloat(entry.Value, 'g', -1, 64)
+	}
+	return inspectedEntry{
+		File:       filepath.Base(path),
+		Offset:     entry.Offset(),
+		Type:       entry.Type,
+		Mode:       entry.MultiprocessMode,
+		PID:        entry.PID,
+		FamilyName: entry.FamilyName,
+		MetricName: entry.MetricName,
+		Labels:     entry.RawLabels(),
+		Value:      value,
+	}
+}
+
+// formatLabels formats labels like the exposition format, sorted by name
+func formatLabels(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Validate checks every .db file in dir, writing a report of each file and
+// any type conflicts between files. It reports whether all files are valid.
+func Validate(w io.Writer, dir string) (bool, error) {
+	files, err := dbFiles(dir)
+	if err != nil {
+		return false, err
+	}
+
+	valid := true
+	types := make(map[string]map[string][]string) // family -> type -> files
+	for _, file := range files {
+		name := filepath.Base(file)
+		entries, skipped, err := readEntries(file)
+		if err != nil {
+			valid = false
+			fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+			continue
+		}
+		if len(skipped) > 0 {
+			valid = false
+			fmt.Fprintf(w, "FAIL %s: %d entries, %d corrupted\n", name, len(entries), len(skipped))
+			for _, err := range skipped {
+				fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+			}
+		} else {
+			fmt.Fprintf(w, "ok   %s: %d entries\n", name, len(entries))
+		}
+
+		for _, entry := range entries {
+			if types[entry.FamilyName] == nil {
+				types[entry.FamilyName] = make(map[string][]string)
+			}
+			if !slices.Contains(types[entry.FamilyName][entry.Type], name) {
+				types[entry.FamilyName][entry.Type] = append(types[entry.FamilyName][entry.Type], name)
+			}
+		}
+	}
+
+	for _, family := range slices.Sorted(maps.Keys(types)) {
+		if len(types[family]) < 2 {
+			continue
+		}
+		valid = false
+		var seen []string
+		for _, typ := range slices.Sorted(maps.Keys(types[family])) {
+			seen = append(seen, fmt.Sprintf("%s in %s", typ, strings.Join(types[family][typ], ", ")))
+		}
+		fmt.Fprintf(w, "FAIL type conflict for %s: %s\n", family, strings.Join(seen, "; "))
+	}
+
+	return valid, nil
+}
+
+// readEntries reads every entry in the file at path that can be decoded, with
+// the values it stores, and an *EntryError for each that can't. The error is
+// for a file that can't be read at all.
+func readEntries(path string) ([]Entry, []error, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	return r.readUsed()
+}
+
+// dbFiles returns path if it is a file, or the .db files in it if it is a
+// directory, in a stable order.
+func dbFiles(path string) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
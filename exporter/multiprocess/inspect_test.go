@@ -0,0 +1,105 @@
+package multiprocess
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspect_JSON(t *testing.T) {
+	var out bytes.Buffer
+	path := filepath.Join("test_fixtures", "counter", "counter_process_id_673-0.db")
+	if err := Inspect(&out, path, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []inspectedEntry
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var e inspectedEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	first := entries[0]
+	if first.File != "counter_process_id_673-0.db" || first.Offset != 8 || first.PID != "process_id_673" ||
+		first.FamilyName != "widgets_created_total" || first.Labels["type"] != "guinness" || first.Value != 150.0 {
+		t.Errorf("unexpected first entry: %+v", first)
+	}
+	if entries[1].Offset != 96 {
+		t.Errorf("expected second entry at offset 96, got %d", entries[1].Offset)
+	}
+}
+
+func TestInspect_Table(t *testing.T) {
+	var out bytes.Buffer
+	if err := Inspect(&out, filepath.Join("test_fixtures", "histogram"), FormatTable); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !strings.HasPrefix(lines[0], "FILE") {
+		t.Errorf("expected a header line, got %q", lines[0])
+	}
+	if !strings.Contains(out.String(), `{le="+Inf",operation="add"}`) {
+		t.Errorf("expected raw le labels in the output:\n%s", out.String())
+	}
+}
+
+func TestInspect_UnknownFormat(t *testing.T) {
+	if err := Inspect(&bytes.Buffer{}, "test_fixtures", "yaml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		var out bytes.Buffer
+		valid, err := Validate(&out, filepath.Join("test_fixtures", "gauge"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			t.Errorf("expected fixtures to be valid:\n%s", out.String())
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		dir := copyFixtures(t, "counter")
+		writeDB(t, filepath.Join(dir, "gauge_all_process_id_1-0.db"), testEntry{`["widgets_created_total","widgets_created_total",[],[]]`, 1})
+		writeDB(t, filepath.Join(dir, "counter_process_id_2-0.db"),
+			testEntry{`not json`, 1},
+			testEntry{`["widgets_created_total","widgets_created_total",[],[]]`, 2},
+			testEntry{`["widgets_created_total"]`, 3},
+		)
+		writeDB(t, filepath.Join(dir, "invalid.db"))
+
+		var out bytes.Buffer
+		valid, err := Validate(&out, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid {
+			t.Error("expected the directory to be invalid")
+		}
+		for _, want := range []string{
+			"FAIL counter_process_id_2-0.db: 1 entries, 2 corrupted",
+			"FAIL counter_process_id_2-0.db: entry at offset 8: invalid JSON key",
+			"FAIL counter_process_id_2-0.db: entry at offset 104: invalid JSON key: expected 4 elements",
+			"FAIL invalid.db: invalid filename format",
+			"FAIL type conflict for widgets_created_total: counter in",
+			"gauge in gauge_all_process_id_1-0.db",
+			"ok   counter_process_id_673-0.db: 2 entries",
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("expected report to contain %q:\n%s", want, out.String())
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package multiprocess
+
+import (
+	"iter"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitLogInterval is how often a family that is over its limit is logged
+const limitLogInterval = time.Minute
+
+// SeriesLimits caps the number of series served, so a single label with
+// unbounded values can't overwhelm the exporter or Prometheus. A limit of
+// zero means unlimited. Histograms and summaries count as one series per
+// label set.
+type SeriesLimits struct {
+	// PerFamily applies to every family without an entry in Families
+	PerFamily int
+	// Families overrides PerFamily for particular families
+	Families map[string]int
+	// Global applies across all families, after the per-family limits
+	Global int
+}
+
+func (l SeriesLimits) enabled() bool {
+	return l.PerFamily > 0 || l.Global > 0 || len(l.Families) > 0
+}
+
+func (l SeriesLimits) forFamily(family string) int {
+	if limit, ok := l.Families[family]; ok {
+		return limit
+	}
+	return l.PerFamily
+}
+
+// applyLimits returns the groups that fit within the limits. Series are kept
+// in order of their group key, and families in order of their name, so the
+// same series are dropped on every scrape. Dropped series are counted per
+// family.
+func (c *Collector) applyLimits(groups iter.Seq[[]Entry]) iter.Seq[[]Entry] {
+	if !c.limits.enabled() {
+		return groups
+	}
+
+	families := make(map[string][][]Entry)
+	for group := range groups {
+		family := group[0].FamilyName
+		families[family] = append(families[family], group)
+	}
+
+	return func(yield func([]Entry) bool) {
+		budget := c.limits.Global
+		for _, family := range slices.Sorted(maps.Keys(families)) {
+			series := families[family]
+			keep := len(series)
+			if limit := c.limits.forFamily(family); limit > 0 && keep > limit {
+				keep = limit
+			}
+			if c.limits.Global > 0 && keep > budget {
+				keep = budget
+			}
+			budget -= keep
+
+			if dropped := len(series) - keep; dropped > 0 {
+				c.metrics.seriesDropped.WithLabelValues(family).Add(float64(dropped))
+				if c.limitLog.allow(family) {
+					log.Printf("Dropped %d of %d series for %s: over the series limit", dropped, len(series), family)
+				}
+				series = sortByGroupKey(series)
+			}
+
+			for _, group := range series[:keep] {
+				if !yield(group) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sortByGroupKey returns groups sorted by the group key of their first entry
+func sortByGroupKey(groups [][]Entry) [][]Entry {
+	type keyedGroup struct {
+		key   string
+		group []Entry
+	}
+	keyed := make([]keyedGroup, len(groups))
+	for i, group := range groups {
+		keyed[i] = keyedGroup{key: group[0].groupKey(), group: group}
+	}
+	slices.SortFunc(keyed, func(a, b keyedGroup) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	sorted := make([][]Entry, len(keyed))
+	for i, k := range keyed {
+		sorted[i] = k.group
+	}
+	return sorted
+}
+
+// rateLimiter allows an action once per interval for each key. Keys not
+// seen for an interval are forgotten, so keys that come and go, like the
+// paths of files that are deleted, don't pile up.
+type rateLimiter struct {
+	interval time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	last     map[string]time.Time
+	pruned   time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{interval: interval, now: time.Now, last: make(map[string]time.Time)}
+}
+
+func (r *rateLimiter) allow(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.pruned) >= r.interval {
+		// A key last allowed over an interval ago would be allowed anyway
+		maps.DeleteFunc(r.last, func(_ string, last time.Time) bool {
+			return now.Sub(last) >= r.interval
+		})
+		r.pruned = now
+	}
+	if last, ok := r.last[key]; ok && now.Sub(last) < r.interval {
+		return false
+	}
+	r.last[key] = now
+	return true
+}
@@ -0,0 +1,105 @@
+package multiprocess
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector_SeriesLimits(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewCollector(fixtureDir(t, "gauge"),
+		WithLiveness(allAlive),
+		WithMetrics(metrics),
+		WithSeriesLimits(SeriesLimits{
+			PerFamily: 2,
+			Families:  map[string]int{"oven_temperature_celsius": 1},
+			Global:    8,
+		}),
+	)
+
+	// Series are kept in order of their labels, and families in order of
+	// their name, so water_temperature_celsius only gets what is left of the
+	// global limit.
+	expected := `
+# HELP boiler_temperature_celsius Multiprocess metric
+# TYPE boiler_temperature_celsius gauge
+boiler_temperature_celsius 60
+# HELP greenhouse_temperature_celsius Multiprocess metric
+# TYPE greenhouse_temperature_celsius gauge
+greenhouse_temperature_celsius{greenhouse="inside"} 54.3
+# HELP outside_temperature_celsius Multiprocess metric
+# TYPE outside_temperature_celsius gauge
+outside_temperature_celsius{sensor="garden"} 10.9
+# HELP oven_temperature_celsius Multiprocess metric
+# TYPE oven_temperature_celsius gauge
+oven_temperature_celsius{oven="grill",process_id="59891"} 22
+# HELP room_temperature_celsius Multiprocess metric
+# TYPE room_temperature_celsius gauge
+room_temperature_celsius{room="broom_cupboard"} 15.37
+room_temperature_celsius{room="kitchen"} 25.45
+# HELP thermostat_setpoint_celsius Multiprocess metric
+# TYPE thermostat_setpoint_celsius gauge
+thermostat_setpoint_celsius{zone="upstairs"} 21
+# HELP water_temperature_celsius Multiprocess metric
+# TYPE water_temperature_celsius gauge
+water_temperature_celsius{process_id="59891"} 32.1
+`
+	// Collect several times to check the same series are dropped every time
+	for range 3 {
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+			t.Fatalf("CollectAndCompare failed: %v", err)
+		}
+	}
+
+	for family, dropped := range map[string]float64{
+		"greenhouse_temperature_celsius": 0,
+		"oven_temperature_celsius":       9,
+		"room_temperature_celsius":       3,
+		"thermostat_setpoint_celsius":    0,
+		"water_temperature_celsius":      3,
+	} {
+		if got := testutil.ToFloat64(metrics.seriesDropped.WithLabelValues(family)); got != dropped {
+			t.Errorf("expected %v dropped series for %s, got %v", dropped, family, got)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(time.Hour)
+	if !limiter.allow("a") {
+		t.Error("expected the first call for a key to be allowed")
+	}
+	if limiter.allow("a") {
+		t.Error("expected a second call within the interval to be limited")
+	}
+	if !limiter.allow("b") {
+		t.Error("expected keys to be limited independently")
+	}
+}
+
+func TestRateLimiter_ForgetsOldKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := newRateLimiter(time.Minute)
+	limiter.now = clock.Now
+	for i := range 100 {
+		limiter.allow(fmt.Sprintf("skipped:file_%d.db", i))
+	}
+
+	clock.Advance(30 * time.Second)
+	if limiter.allow("skipped:file_0.db") {
+		t.Error("expected a key to be limited within the interval")
+	}
+
+	clock.Advance(time.Minute)
+	if !limiter.allow("skipped:file_100.db") {
+		t.Error("expected a new key to be allowed")
+	}
+	if len(limiter.last) != 1 {
+		t.Errorf("expected keys not seen for an interval to be forgotten, got %d", len(limiter.last))
+	}
+}
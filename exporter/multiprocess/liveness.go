@@ -0,0 +1,156 @@
+package multiprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Liveness reports whether the process that wrote a multiprocess file is
+// still running. The pid argument is the PID part of the filename, e.g.
+// "process_id_59891" or "worker_id_3".
+type Liveness interface {
+	Alive(pid string) bool
+}
+
+// LivenessFunc adapts an ordinary function to the Liveness interface.
+type LivenessFunc func(pid string) bool
+
+// Alive implements Liveness.
+func (f LivenessFunc) Alive(pid string) bool {
+	return f(pid)
+}
+
+// ProcessState is what is known about whether the process that wrote a file
+// is still running
+type ProcessState int
+
+const (
+	// ProcessUnknown means the pid can't be checked
+	ProcessUnknown ProcessState = iota
+	// ProcessRunning means the process is known to be running
+	ProcessRunning
+	// ProcessExited means the process is known to have exited
+	ProcessExited
+)
+
+// StateChecker is implemented by a Liveness that can tell which pids it
+// can't check. Files are only compacted or deleted once their process is
+// known to have exited. A Liveness without it is trusted for every pid.
+type StateChecker interface {
+	State(pid string) ProcessState
+}
+
+// processState asks liveness what it knows about pid
+func processState(liveness Liveness, pid string) ProcessState {
+	if checker, ok := liveness.(StateChecker); ok {
+		return checker.State(pid)
+	}
+	if liveness.Alive(pid) {
+		return ProcessRunning
+	}
+	return ProcessExited
+}
+
+// ProcLiveness decides liveness from the PID part of a filename.
+//
+// process_id_N files (and bare numeric PIDs) are written by a single OS
+// process, so they have exited once Root/N is gone. This requires the
+// exporter to share a PID namespace with the application. Unless
+// SharedNamespace says it does, a pid missing from Root may just be in a
+// namespace the exporter can't see, so it is treated as alive and its state
+// as unknown: live gauges keep being served, and files are never compacted
+// or deleted while the process may still have them mapped.
+//
+// worker_id_N files are written by whichever Pitchfork or Unicorn worker
+// currently holds slot N, so the OS PID says nothing about them. They are
+// delegated to Workers, or treated as alive when Workers is nil, as nothing
+// in the exporter knows which slots are in use: live gauges from a slot are
+// served until a new worker takes it over and writes them again.
+//
+// Any other format, including puma_N, is treated as alive, so unknown pid
+// providers never lose metrics.
+type ProcLiveness struct {
+	Root    string
+	Workers Liveness
+	// SharedNamespace declares that Root shows the application's pid
+	// namespace, so a pid missing from it has exited
+	SharedNamespace bool
+}
+
+// NewProcLiveness returns a ProcLiveness that checks processes under root
+// (usually /proc) and delegates worker ids to workers, which may be nil.
+func NewProcLiveness(root string, workers Liveness) *ProcLiveness {
+	return &ProcLiveness{Root: root, Workers: workers}
+}
+
+// Alive implements Liveness.
+func (l *ProcLiveness) Alive(pid string) bool {
+	if n, ok := strings.CutPrefix(pid, "process_id_"); ok {
+		return l.processAlive(n)
+	}
+	if isNumeric(pid) {
+		return l.processAlive(pid)
+	}
+	if strings.HasPrefix(pid, "worker_id_") && l.Workers != nil {
+		return l.Workers.Alive(pid)
+	}
+	return true
+}
+
+// State implements StateChecker.
+func (l *ProcLiveness) State(pid string) ProcessState {
+	if n, ok := strings.CutPrefix(pid, "process_id_"); ok {
+		return l.processState(n)
+	}
+	if isNumeric(pid) {
+		return l.processState(pid)
+	}
+	if strings.HasPrefix(pid, "worker_id_") && l.Workers != nil {
+		return processState(l.Workers, pid)
+	}
+	return ProcessUnknown
+}
+
+// processState checks for Root/n, which is only known to mean the process
+// has exited when Root shows the application's pid namespace
+func (l *ProcLiveness) processState(n string) ProcessState {
+	if !isNumeric(n) {
+		return ProcessUnknown
+	}
+	_, err := os.Stat(filepath.Join(l.Root, n))
+	switch {
+	case err == nil:
+		return ProcessRunning
+	case os.IsNotExist(err) && l.SharedNamespace:
+		return ProcessExited
+	default:
+		return ProcessUnknown
+	}
+}
+
+// processAlive reports a process alive unless it is known to have exited,
+// so a permission problem or a namespace the exporter can't see can't make
+// every live gauge vanish.
+func (l *ProcLiveness) processAlive(n string) bool {
+	return l.processState(n) != ProcessExited
+}
+
+// isNumeric reports whether s is a non-empty string of ASCII digits.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isLiveMode reports whether a gauge multiprocess mode only includes values
+// from running processes.
+func isLiveMode(mode string) bool {
+	return strings.HasPrefix(mode, "live")
+}
@@ -0,0 +1,145 @@
+package multiprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProcLiveness_Alive(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "59891"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	workers := LivenessFunc(func(pid string) bool { return pid == "worker_id_1" })
+
+	tests := []struct {
+		name    string
+		pid     string
+		workers Liveness
+		shared  bool
+		alive   bool
+	}{
+		{name: "running process", pid: "process_id_59891", alive: true},
+		{name: "missing process", pid: "process_id_59892", alive: true},
+		{name: "exited process", pid: "process_id_59892", shared: true, alive: false},
+		{name: "bare running pid", pid: "59891", alive: true},
+		{name: "bare missing pid", pid: "59892", alive: true},
+		{name: "bare exited pid", pid: "59892", shared: true, alive: false},
+		{name: "malformed process id", pid: "process_id_../59892", alive: true},
+		{name: "worker without source", pid: "worker_id_2", alive: true},
+		{name: "running worker", pid: "worker_id_1", workers: workers, alive: true},
+		{name: "stopped worker", pid: "worker_id_2", workers: workers, alive: false},
+		{name: "unknown format", pid: "puma_0", alive: true},
+		{name: "empty", pid: "", alive: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			liveness := NewProcLiveness(root, tt.workers)
+			liveness.SharedNamespace = tt.shared
+			if got := liveness.Alive(tt.pid); got != tt.alive {
+				t.Errorf("Alive(%q) = %v, want %v", tt.pid, got, tt.alive)
+			}
+		})
+	}
+}
+
+func TestProcLiveness_State(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "59891"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	workers := LivenessFunc(func(pid string) bool { return pid == "worker_id_1" })
+
+	tests := []struct {
+		name    string
+		pid     string
+		workers Liveness
+		shared  bool
+		state   ProcessState
+	}{
+		{name: "running process", pid: "process_id_59891", state: ProcessRunning},
+		{name: "missing process", pid: "process_id_59892", state: ProcessUnknown},
+		{name: "exited process", pid: "process_id_59892", shared: true, state: ProcessExited},
+		{name: "bare exited pid", pid: "59892", shared: true, state: ProcessExited},
+		{name: "malformed process id", pid: "process_id_../59892", shared: true, state: ProcessUnknown},
+		{name: "worker without source", pid: "worker_id_2", shared: true, state: ProcessUnknown},
+		{name: "running worker", pid: "worker_id_1", workers: workers, state: ProcessRunning},
+		{name: "stopped worker", pid: "worker_id_2", workers: workers, state: ProcessExited},
+		{name: "unknown format", pid: "puma_0", shared: true, state: ProcessUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			liveness := NewProcLiveness(root, tt.workers)
+			liveness.SharedNamespace = tt.shared
+			if got := liveness.State(tt.pid); got != tt.state {
+				t.Errorf("State(%q) = %v, want %v", tt.pid, got, tt.state)
+			}
+		})
+	}
+}
+
+func TestCollector_CollectLiveness(t *testing.T) {
+	dead := LivenessFunc(func(pid string) bool { return pid != "process_id_59892" })
+	collector := NewCollector(fixtureDir(t, "gauge"), WithLiveness(dead))
+
+	// process_id_59892 only wrote liveall and livesum gauges, and max and
+	// mostrecent gauges. The max and mostrecent gauges are unaffected by
+	// liveness, the others drop its values.
+	expected := `
+# HELP boiler_temperature_celsius Multiprocess metric
+# TYPE boiler_temperature_celsius gauge
+boiler_temperature_celsius 60
+# HELP greenhouse_temperature_celsius Multiprocess metric
+# TYPE greenhouse_temperature_celsius gauge
+greenhouse_temperature_celsius{greenhouse="inside"} 27.1
+# HELP outside_temperature_celsius Multiprocess metric
+# TYPE outside_temperature_celsius gauge
+outside_temperature_celsius{sensor="garden"} 10.9
+# HELP oven_temperature_celsius Multiprocess metric
+# TYPE oven_temperature_celsius gauge
+oven_temperature_celsius{oven="grill",process_id="59891"} 22
+oven_temperature_celsius{oven="top",process_id="59891"} 150.1
+oven_temperature_celsius{oven="top",process_id="59893"} 155.2
+# HELP room_temperature_celsius Multiprocess metric
+# TYPE room_temperature_celsius gauge
+room_temperature_celsius{room="broom_cupboard"} 15.37
+room_temperature_celsius{room="kitchen"} 25.45
+room_temperature_celsius{room="lounge"} 22.4
+# HELP thermostat_setpoint_celsius Multiprocess metric
+# TYPE thermostat_setpoint_celsius gauge
+thermostat_setpoint_celsius{zone="upstairs"} 21
+# HELP water_temperature_celsius Multiprocess metric
+# TYPE water_temperature_celsius gauge
+water_temperature_celsius{process_id="59891"} 32.1
+water_temperature_celsius{process_id="59893"} 33.1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
+
+func TestCollector_LivenessNeedsSharedNamespace(t *testing.T) {
+	// None of the fixtures' pids are in this procfs, as when the exporter
+	// can't see the application's pid namespace
+	root := t.TempDir()
+	dir := fixtureDir(t, "gauge")
+	all := testutil.CollectAndCount(NewCollector(dir, WithLiveness(allAlive)))
+
+	// Without a shared namespace, live gauges are all served
+	if got := testutil.CollectAndCount(NewCollector(dir, WithLiveness(NewProcLiveness(root, nil)))); got != all {
+		t.Errorf("expected all %d series by default, got %d", all, got)
+	}
+
+	// With one, their processes have exited
+	shared := NewProcLiveness(root, nil)
+	shared.SharedNamespace = true
+	if got := testutil.CollectAndCount(NewCollector(dir, WithLiveness(shared))); got >= all {
+		t.Errorf("expected live gauges of exited processes to be dropped, got %d of %d series", got, all)
+	}
+}
@@ -0,0 +1,84 @@
+package multiprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// metadataFilename is the sidecar written to the multiprocess directory by
+// Promenade::Metadata (lib/promenade/metadata.rb)
+const metadataFilename = "promenade_metadata.json"
+
+// defaultHelp is used for families the Ruby side has no metadata for
+const defaultHelp = "Multiprocess metric"
+
+// Metadata describes a metric family as it was defined with the Ruby DSL. Its
+// type is the current code's, so it settles conflicts with files written
+// before the type changed.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// help returns the help text to serve for the family
+func (m Metadata) help() string {
+	if m.Help == "" {
+		return defaultHelp
+	}
+	return m.Help
+}
+
+// metadataCache reloads the metadata sidecar whenever it is replaced. If it
+// can't be read the last version that could is kept.
+type metadataCache struct {
+	path     string
+	mu       sync.Mutex
+	stat     os.FileInfo
+	families map[string]Metadata
+}
+
+func newMetadataCache(dir string) *metadataCache {
+	return &metadataCache{path: filepath.Join(dir, metadataFilename)}
+}
+
+// load returns the metadata for every family, keyed by family name
+func (m *metadataCache) load() map[string]Metadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stat, err := os.Stat(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		m.stat, m.families = nil, nil
+		return nil
+	}
+	if err != nil || m.unchanged(stat) {
+		return m.families
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return m.families
+	}
+	var families map[string]Metadata
+	if err := json.Unmarshal(data, &families); err != nil {
+		log.Printf("Could not parse metadata file %s: %v", m.path, err)
+		return m.families
+	}
+
+	m.stat, m.families = stat, families
+	return m.families
+}
+
+// unchanged reports whether stat describes the file that was last loaded.
+// The Ruby side replaces the file atomically, so every update is a new inode.
+func (m *metadataCache) unchanged(stat os.FileInfo) bool {
+	return m.stat != nil &&
+		os.SameFile(m.stat, stat) &&
+		m.stat.ModTime().Equal(stat.ModTime()) &&
+		m.stat.Size() == stat.Size()
+}
@@ -0,0 +1,73 @@
+package multiprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeMetadata replaces the metadata sidecar atomically, like the Ruby side
+func writeMetadata(t *testing.T, dir, contents string) {
+	t.Helper()
+	tmp := filepath.Join(dir, metadataFilename+".tmp")
+	if err := os.WriteFile(tmp, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, metadataFilename)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollector_Metadata(t *testing.T) {
+	dir := copyFixtures(t, "summary")
+	writeMetadata(t, dir, `{
+		"api_client_http_timing": {"type": "summary", "help": "record how long requests to the api are taking", "unit": "seconds"}
+	}`)
+	collector := NewCollector(dir, WithLiveness(allAlive))
+
+	expect := func(expected string) {
+		t.Helper()
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+			t.Errorf("CollectAndCompare failed: %v", err)
+		}
+	}
+
+	expect(`
+# HELP api_client_http_timing record how long requests to the api are taking
+# TYPE api_client_http_timing summary
+api_client_http_timing_count{method="get",path="/api/v1/users"} 6
+api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+`)
+
+	// Updates are picked up
+	writeMetadata(t, dir, `{"api_client_http_timing": {"type": "summary", "help": "API timings"}}`)
+	expect(`
+# HELP api_client_http_timing API timings
+# TYPE api_client_http_timing summary
+api_client_http_timing_count{method="get",path="/api/v1/users"} 6
+api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+`)
+
+	// A file that can't be parsed leaves the last good metadata in place
+	writeMetadata(t, dir, `{"api_client_http_timing": `)
+	expect(`
+# HELP api_client_http_timing API timings
+# TYPE api_client_http_timing summary
+api_client_http_timing_count{method="get",path="/api/v1/users"} 6
+api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+`)
+
+	// Without metadata the generic help text is used
+	if err := os.Remove(filepath.Join(dir, metadataFilename)); err != nil {
+		t.Fatal(err)
+	}
+	expect(`
+# HELP api_client_http_timing Multiprocess metric
+# TYPE api_client_http_timing summary
+api_client_http_timing_count{method="get",path="/api/v1/users"} 6
+api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+`)
+}
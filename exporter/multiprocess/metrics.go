@@ -0,0 +1,134 @@
+package multiprocess
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics instruments the multiprocess collector itself, so that files that
+// can't be read and metrics that can't be served don't go unnoticed.
+type Metrics struct {
+	filesDiscovered  prometheus.Counter
+	filesParsed      prometheus.Counter
+	filesFailed      *prometheus.CounterVec
+	filesExpired     prometheus.Counter
+	filesDeleted     prometheus.Counter
+	entriesRead      prometheus.Counter
+	entriesSkipped   *prometheus.CounterVec
+	seriesEmitted    prometheus.Counter
+	bytesRead        prometheus.Counter
+	collectDuration  prometheus.Histogram
+	invalidMetrics   prometheus.Counter
+	seriesDropped    *prometheus.CounterVec
+	familyConflicts  *prometheus.CounterVec
+	seriesCollisions *prometheus.CounterVec
+
+	histogramsReconciled *prometheus.CounterVec
+	invalidHistograms    *prometheus.CounterVec
+
+	snapshotRebuildDuration prometheus.Histogram
+}
+
+// NewMetrics creates the collector's own metrics and registers them with reg.
+// A nil reg creates metrics that are not exposed anywhere.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	m := &Metrics{
+		filesDiscovered: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_files_discovered_total",
+			Help: "Multiprocess files found in the directory, counted on every collection.",
+		}),
+		filesParsed: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_files_parsed_total",
+			Help: "Multiprocess files that were read successfully.",
+		}),
+		filesFailed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_files_failed_total",
+			Help: "Multiprocess files that were skipped because they could not be read, by reason.",
+		}, []string{"reason"}),
+		filesExpired: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_files_expired_total",
+			Help: "Multiprocess files ignored because they had not been written within the TTL, counted on every collection.",
+		}),
+		filesDeleted: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_files_deleted_total",
+			Help: "Expired multiprocess files deleted by the exporter.",
+		}),
+		entriesRead: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_entries_read_total",
+			Help: "Entries read from multiprocess files.",
+		}),
+		entriesSkipped: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_entries_skipped_total",
+			Help: "Entries that could not be decoded and were skipped, while the rest of their file was read, by reason.",
+		}, []string{"reason"}),
+		seriesEmitted: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_series_emitted_total",
+			Help: "Metrics served after merging multiprocess entries.",
+		}),
+		bytesRead: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_bytes_read_total",
+			Help: "Bytes of multiprocess files read.",
+		}),
+		collectDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "promenade_exporter_collect_duration_seconds",
+			Help:    "Time taken to read and merge multiprocess files.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}),
+		invalidMetrics: factory.NewCounter(prometheus.CounterOpts{
+			Name: "promenade_exporter_invalid_metrics_total",
+			Help: "Merged metrics that were skipped because they could not be served.",
+		}),
+		seriesDropped: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_series_dropped_total",
+			Help: "Series that were not served because their family was over its series limit.",
+		}, []string{"family"}),
+		familyConflicts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_family_conflicts_total",
+			Help: "Families found with conflicting types, multiprocess modes or histogram buckets across files, counted on every collection, by kind.",
+		}, []string{"family", "kind"}),
+		seriesCollisions: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_series_collisions_total",
+			Help: "Series not served because another multiprocess directory served the same series, or the same family with a different type, or because a const label made two series of a directory the same, by reason.",
+		}, []string{"family", "reason"}),
+		histogramsReconciled: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_histograms_reconciled_total",
+			Help: "Histogram families written with different bucket layouts that were merged onto the union of their bounds, counted on every collection.",
+		}, []string{"family"}),
+		invalidHistograms: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "promenade_exporter_histograms_invalid_total",
+			Help: "Merged histogram series whose buckets were inconsistent, by reason: not_monotonic series are skipped, count_mismatch series are served with their +Inf bucket as the count.",
+		}, []string{"family", "reason"}),
+		snapshotRebuildDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "promenade_exporter_snapshot_rebuild_duration_seconds",
+			Help:    "Time taken to rebuild the snapshot of multiprocess metrics in the background.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}),
+	}
+	// Initialise every reason so that rates work from the first failure
+	for _, reason := range failureReasons {
+		m.filesFailed.WithLabelValues(reason)
+		m.entriesSkipped.WithLabelValues(reason)
+	}
+	return m
+}
+
+var failureReasons = []string{"filename_format", "truncated", "corrupted_entry", "json", "read"}
+
+// failureReason classifies an error from reading a file for the reason label
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrFilenameFormat):
+		return "filename_format"
+	case errors.Is(err, ErrTruncated):
+		return "truncated"
+	case errors.Is(err, ErrCorruptedEntry):
+		return "corrupted_entry"
+	case errors.Is(err, ErrInvalidKey):
+		return "json"
+	default:
+		return "read"
+	}
+}
@@ -0,0 +1,74 @@
+package multiprocess
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector_Metrics(t *testing.T) {
+	dir := copyFixtures(t, "counter")
+
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"), testEntry{`not json`, 1})
+	writeDB(t, filepath.Join(dir, "counter_process_id_2-0.db"), testEntry{`["","",[],[]]`, 1})
+	if err := os.WriteFile(filepath.Join(dir, "invalid.db"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(truncated, 10000)
+	if err := os.WriteFile(filepath.Join(dir, "counter_process_id_3-0.db"), truncated, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := make([]byte, 16)
+	binary.LittleEndian.PutUint32(corrupted, 16)
+	binary.LittleEndian.PutUint32(corrupted[headerSize:], 1000)
+	if err := os.WriteFile(filepath.Join(dir, "counter_process_id_4-0.db"), corrupted, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	collector := NewCollector(dir, WithLiveness(allAlive), WithMetrics(metrics))
+	if count := testutil.CollectAndCount(collector); count != 3 {
+		t.Errorf("expected 3 metrics, got %d", count)
+	}
+
+	tests := []struct {
+		name     string
+		counter  prometheus.Collector
+		expected float64
+	}{
+		{name: "discovered", counter: metrics.filesDiscovered, expected: 10},
+		{name: "parsed", counter: metrics.filesParsed, expected: 8},
+		{name: "filename format", counter: metrics.filesFailed.WithLabelValues("filename_format"), expected: 1},
+		{name: "truncated", counter: metrics.filesFailed.WithLabelValues("truncated"), expected: 1},
+		{name: "corrupted entry", counter: metrics.filesFailed.WithLabelValues("corrupted_entry"), expected: 0},
+		{name: "json", counter: metrics.filesFailed.WithLabelValues("json"), expected: 0},
+		{name: "read", counter: metrics.filesFailed.WithLabelValues("read"), expected: 0},
+		{name: "skipped corrupted entry", counter: metrics.entriesSkipped.WithLabelValues("corrupted_entry"), expected: 1},
+		{name: "skipped json", counter: metrics.entriesSkipped.WithLabelValues("json"), expected: 2},
+		{name: "entries", counter: metrics.entriesRead, expected: 6},
+		{name: "series", counter: metrics.seriesEmitted, expected: 3},
+		{name: "invalid", counter: metrics.invalidMetrics, expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tt.counter); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(metrics.bytesRead); got <= 0 {
+		t.Errorf("expected bytes read to be counted, got %v", got)
+	}
+	if got := testutil.CollectAndCount(reg, "promenade_exporter_collect_duration_seconds"); got != 1 {
+		t.Errorf("expected the collect duration to be registered, got %d series", got)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package multiprocess
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps the first size bytes of f read-only. The mapping stays valid
+// after f is closed, and sees writes made through the Ruby client's own
+// mapping of the same file.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// munmap releases a mapping created by mmapFile
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package multiprocess
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on non-Linux platforms, so files are always read.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+// munmap is a no-op on non-Linux platforms.
+func munmap(data []byte) error { return nil }
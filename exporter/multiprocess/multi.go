@@ -0,0 +1,226 @@
+package multiprocess
+
+import (
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// servedMetric is a metric along with the identity it was built from, so
+// that metrics from several collectors can be checked against each other
+type servedMetric struct {
+	prometheus.Metric
+	name   string
+	typ    string
+	help   string
+	labels prometheus.Labels
+}
+
+func newServedMetric(metric prometheus.Metric, entry Entry, help string, labels prometheus.Labels) *servedMetric {
+	name := entry.MetricName
+	if entry.Type == "histogram" || entry.Type == "summary" {
+		name = entry.FamilyName
+	}
+	return &servedMetric{Metric: metric, name: name, typ: entry.Type, help: help, labels: labels}
+}
+
+// key identifies the series, as the registry does
+func (m *servedMetric) key() string {
+	parts := make([]string, 0, len(m.labels))
+	for _, name := range slices.Sorted(maps.Keys(m.labels)) {
+		parts = append(parts, name+"="+m.labels[name])
+	}
+	return m.name + "{" + strings.Join(parts, ",") + "}"
+}
+
+// withHelp returns the metric described with help instead of its own
+func (m *servedMetric) withHelp(help string) prometheus.Metric {
+	return describedMetric{
+		Metric: m.Metric,
+		desc:   prometheus.NewDesc(m.name, help, nil, m.labels),
+	}
+}
+
+type describedMetric struct {
+	prometheus.Metric
+	desc *prometheus.Desc
+}
+
+func (m describedMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// MultiCollector serves the metrics of several collectors, usually one per
+// multiprocess directory, as one. A series served by more than one of them,
+// or a family served with different types, would fail the whole scrape, so
+// only the first collector's is served and the collision is counted and
+// logged. Families with different help text are served with the first.
+type MultiCollector struct {
+	source      CollectorSource
+	globalLimit int
+	metrics     *Metrics
+	log         *rateLimiter
+	limitLog    *rateLimiter
+}
+
+// CollectorSource returns the collectors to serve, in order of precedence.
+// It is called on every collect, so collectors can come and go.
+type CollectorSource func() []prometheus.Collector
+
+// Collectors is a CollectorSource that always serves collectors
+func Collectors(collectors ...prometheus.Collector) CollectorSource {
+	return func() []prometheus.Collector { return collectors }
+}
+
+// MultiOption configures a MultiCollector
+type MultiOption func(*MultiCollector)
+
+// WithGlobalSeriesLimit caps the number of series served across all the
+// collectors, like SeriesLimits.Global does for one. Zero is unlimited.
+func WithGlobalSeriesLimit(limit int) MultiOption {
+	return func(c *MultiCollector) {
+		c.globalLimit = limit
+	}
+}
+
+// NewMultiCollector combines the collectors from source. Collisions and
+// dropped series are recorded in metrics, which may be nil.
+func NewMultiCollector(metrics *Metrics, source CollectorSource, opts ...MultiOption) *MultiCollector {
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+	c := &MultiCollector{
+		source:   source,
+		metrics:  metrics,
+		log:      newRateLimiter(limitLogInterval),
+		limitLog: newRateLimiter(limitLogInterval),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector. Like Collector, it is unchecked.
+func (c *MultiCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (c *MultiCollector) Collect(ch chan<- prometheus.Metric) {
+	// Collect in parallel, then serve in order so precedence is stable
+	collectors := c.source()
+	results := make([][]prometheus.Metric, len(collectors))
+	var wg sync.WaitGroup
+	for i, collector := range collectors {
+		wg.Go(func() {
+			metrics := make(chan prometheus.Metric)
+			go func() {
+				collector.Collect(metrics)
+				close(metrics)
+			}()
+			for metric := range metrics {
+				results[i] = append(results[i], metric)
+			}
+		})
+	}
+	wg.Wait()
+
+	type family struct{ typ, help string }
+	families := make(map[string]family)
+	seen := make(map[string]bool)
+	var kept []keyedMetric
+	for _, metrics := range results {
+		for _, metric := range metrics {
+			served, ok := metric.(*servedMetric)
+			if !ok {
+				ch <- metric
+				continue
+			}
+
+			key := served.key()
+			if f, ok := families[served.name]; ok {
+				if f.typ != served.typ {
+					c.collision(served.name, "type", served.typ+" after "+f.typ)
+					continue
+				}
+				if seen[key] {
+					c.collision(served.name, "series", key)
+					continue
+				}
+				if f.help != served.help {
+					metric = served.withHelp(f.help)
+				}
+			} else {
+				families[served.name] = family{typ: served.typ, help: served.help}
+			}
+			seen[key] = true
+			kept = append(kept, keyedMetric{Metric: metric, name: served.name, key: key})
+		}
+	}
+
+	for _, metric := range c.applyGlobalLimit(kept) {
+		ch <- metric.Metric
+	}
+}
+
+// keyedMetric is a metric to serve, with the family and series it is of
+type keyedMetric struct {
+	prometheus.Metric
+	name string
+	key  string
+}
+
+// applyGlobalLimit returns the metrics that fit within the global limit.
+// Like applyLimits, series are kept in order of their family's name, then
+// of their labels, so the same series are dropped on every scrape.
+func (c *MultiCollector) applyGlobalLimit(metrics []keyedMetric) []keyedMetric {
+	if c.globalLimit <= 0 || len(metrics) <= c.globalLimit {
+		return metrics
+	}
+
+	slices.SortFunc(metrics, func(a, b keyedMetric) int {
+		if order := strings.Compare(a.name, b.name); order != 0 {
+			return order
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	dropped := make(map[string]int)
+	for _, metric := range metrics[c.globalLimit:] {
+		dropped[metric.name]++
+	}
+	for _, name := range slices.Sorted(maps.Keys(dropped)) {
+		c.metrics.seriesDropped.WithLabelValues(name).Add(float64(dropped[name]))
+		if c.limitLog.allow(name) {
+			log.Printf("Dropped %d series for %s: over the global series limit", dropped[name], name)
+		}
+	}
+	return metrics[:c.globalLimit]
+}
+
+// Units returns the units of the families served by each collector that
+// knows them, taking precedence in the same order as series
+func (c *MultiCollector) Units() map[string]string {
+	units := make(map[string]string)
+	for _, collector := range c.source() {
+		source, ok := collector.(interface{ Units() map[string]string })
+		if !ok {
+			continue
+		}
+		for name, unit := range source.Units() {
+			if _, ok := units[name]; !ok {
+				units[name] = unit
+			}
+		}
+	}
+	return units
+}
+
+func (c *MultiCollector) collision(name, reason, detail string) {
+	c.metrics.seriesCollisions.WithLabelValues(name, reason).Inc()
+	if c.log.allow(name) {
+		log.Printf("Not serving %s from more than one directory: %s collision (%s)", name, reason, detail)
+	}
+}
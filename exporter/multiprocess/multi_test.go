@@ -0,0 +1,176 @@
+package multiprocess
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeComponentDirs writes the directories of two applications in one pod,
+// which both count requests but disagree about the type of queue
+func writeComponentDirs(t *testing.T) (string, string) {
+	t.Helper()
+	web, karafka := t.TempDir(), t.TempDir()
+	writeDB(t, filepath.Join(web, "counter_process_id_1-0.db"),
+		testEntry{key: `["requests","requests",[],[]]`, value: 3},
+	)
+	writeDB(t, filepath.Join(web, "gauge_max_process_id_1-0.db"),
+		testEntry{key: `["queue","queue",[],[]]`, value: 1},
+	)
+	writeMetadata(t, web, `{"requests": {"type": "counter", "help": "Requests handled"}}`)
+	writeDB(t, filepath.Join(karafka, "counter_process_id_2-0.db"),
+		testEntry{key: `["requests","requests",[],[]]`, value: 5},
+		testEntry{key: `["queue","queue",[],[]]`, value: 2},
+	)
+	return web, karafka
+}
+
+func TestMultiCollector(t *testing.T) {
+	web, karafka := writeComponentDirs(t)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewMultiCollector(metrics, Collectors(
+		NewCollector(web, WithLiveness(allAlive), WithConstLabels(prometheus.Labels{"component": "web"})),
+		NewCollector(karafka, WithLiveness(allAlive), WithConstLabels(prometheus.Labels{"component": "karafka"})),
+	))
+
+	// Help text comes from the first directory with the family
+	expected := `
+# HELP queue Multiprocess metric
+# TYPE queue gauge
+queue{component="web"} 1
+# HELP requests Requests handled
+# TYPE requests counter
+requests{component="karafka"} 5
+requests{component="web"} 3
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatalf("CollectAndCompare failed: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.seriesCollisions.WithLabelValues("queue", "type")); got != 1 {
+		t.Errorf("expected 1 type collision for queue, got %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.seriesCollisions); got != 1 {
+		t.Errorf("expected only the type collision, got %d", got)
+	}
+}
+
+func TestMultiCollector_SeriesCollisions(t *testing.T) {
+	web, karafka := writeComponentDirs(t)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewMultiCollector(metrics, Collectors(
+		NewCollector(web, WithLiveness(allAlive)),
+		NewCollector(karafka, WithLiveness(allAlive)),
+	))
+
+	// Without labels to tell them apart, the first directory wins
+	expected := `
+# HELP queue Multiprocess metric
+# TYPE queue gauge
+queue 1
+# HELP requests Requests handled
+# TYPE requests counter
+requests 3
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatalf("CollectAndCompare failed: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.seriesCollisions.WithLabelValues("requests", "series")); got != 1 {
+		t.Errorf("expected 1 series collision for requests, got %v", got)
+	}
+}
+
+func TestMultiCollector_Snapshots(t *testing.T) {
+	web, karafka := writeComponentDirs(t)
+	var snapshots []prometheus.Collector
+	for _, dir := range []string{web, karafka} {
+		snapshot, err := NewSnapshotCollector(NewCollector(dir, WithLiveness(allAlive)), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { snapshot.Close() })
+		snapshots = append(snapshots, snapshot)
+	}
+
+	// Each directory's snapshot age is labelled with the directory, so they
+	// don't collide even when the directories have no labels of their own
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewMultiCollector(metrics, Collectors(snapshots...))
+	if got := testutil.CollectAndCount(collector, snapshotAgeName); got != 2 {
+		t.Errorf("expected a snapshot age per directory, got %d", got)
+	}
+	if got := testutil.CollectAndCount(metrics.seriesCollisions); got != 2 {
+		t.Errorf("expected only the collisions of requests and queue, got %d", got)
+	}
+}
+
+func TestCollector_ConstLabelCollision(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"),
+		testEntry{`["requests","requests",["component"],["api"]]`, 1},
+		testEntry{`["requests","requests",["component"],["admin"]]`, 2},
+	)
+
+	// The const label replaces the label that sets the series apart, so only
+	// one is served, and the collision is put down to the const label rather
+	// than another directory
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewMultiCollector(metrics, Collectors(
+		NewCollector(dir, WithLiveness(allAlive), WithMetrics(metrics), WithConstLabels(prometheus.Labels{"component": "web"})),
+	))
+	if got := testutil.CollectAndCount(collector, "requests"); got != 1 {
+		t.Errorf("expected one series of requests, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.seriesCollisions.WithLabelValues("requests", "const_label")); got != 1 {
+		t.Errorf("expected a const_label collision, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.seriesCollisions.WithLabelValues("requests", "series")); got != 0 {
+		t.Errorf("expected no collision between directories, got %v", got)
+	}
+}
+
+func TestMultiCollector_GlobalSeriesLimit(t *testing.T) {
+	web, karafka := writeComponentDirs(t)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	collector := NewMultiCollector(metrics, Collectors(
+		NewCollector(web, WithLiveness(allAlive), WithConstLabels(prometheus.Labels{"component": "web"})),
+		NewCollector(karafka, WithLiveness(allAlive), WithConstLabels(prometheus.Labels{"component": "karafka"})),
+	), WithGlobalSeriesLimit(2))
+
+	// The limit is shared by both directories: queue comes first, leaving
+	// room for one series of requests
+	expected := `
+# HELP queue Multiprocess metric
+# TYPE queue gauge
+queue{component="web"} 1
+# HELP requests Requests handled
+# TYPE requests counter
+requests{component="karafka"} 5
+`
+	for range 3 {
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+			t.Fatalf("CollectAndCompare failed: %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.seriesDropped.WithLabelValues("requests")); got != 3 {
+		t.Errorf("expected 1 dropped series of requests per collect, got %v", got)
+	}
+}
+
+func TestMultiCollector_CollectorSource(t *testing.T) {
+	web, karafka := writeComponentDirs(t)
+	collectors := []prometheus.Collector{NewCollector(web, WithLiveness(allAlive))}
+	collector := NewMultiCollector(nil, func() []prometheus.Collector { return collectors })
+	if got := testutil.CollectAndCount(collector, "requests"); got != 1 {
+		t.Errorf("expected requests from one directory, got %d", got)
+	}
+
+	// Collectors added later are served from the next collect
+	collectors = append(collectors, NewCollector(karafka, WithLiveness(allAlive), WithConstLabels(prometheus.Labels{"component": "karafka"})))
+	if got := testutil.CollectAndCount(collector, "requests"); got != 2 {
+		t.Errorf("expected requests from both directories, got %d", got)
+	}
+}
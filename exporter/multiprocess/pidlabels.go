@@ -0,0 +1,153 @@
+package multiprocess
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// PIDLabelRule recognises one format of the pid part of filenames. Each
+// named group in Regex becomes a label, e.g. worker_(?P<worker>\d+).
+type PIDLabelRule struct {
+	Regex string `yaml:"regex"`
+}
+
+// defaultPIDLabelRules cover the pid providers of prometheus-client-mmap and
+// Promenade: process_id_N by default, worker_id_N from the Unicorn and
+// Pitchfork providers, puma_N from the Puma provider, and the bare pids
+// written by Python's prometheus_client.
+var defaultPIDLabelRules = []PIDLabelRule{
+	{Regex: `process_id_(?P<process_id>\d+)`},
+	{Regex: `worker_id_(?P<worker>\d+)`},
+	{Regex: `puma_(?P<worker>\d+)`},
+	{Regex: `(?P<process_id>\d+)`},
+}
+
+// defaultPIDLabeler recognises the default formats and drops the raw pid label
+func defaultPIDLabeler() *PIDLabeler {
+	l, err := NewPIDLabeler(nil, false)
+	if err != nil {
+		panic(err) // The default rules are known to compile
+	}
+	return l
+}
+
+// PIDLabeler turns the pid part of a filename into the labels that identify
+// the process in gauges that keep one series per process. Pids that no rule
+// recognises are served as they are, in the pid label. A PIDLabeler may be
+// shared by several Collectors.
+type PIDLabeler struct {
+	rules   []*regexp.Regexp
+	keepPID bool
+}
+
+// NewPIDLabeler compiles rules, which are tried in order before the default
+// rules. With keepPID the raw pid label is served alongside the structured ones.
+func NewPIDLabeler(rules []PIDLabelRule, keepPID bool) (*PIDLabeler, error) {
+	l := &PIDLabeler{keepPID: keepPID}
+	for i, rule := range append(rules, defaultPIDLabelRules...) {
+		regex, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("pid label rule %d: invalid regex %q: %w", i, rule.Regex, err)
+		}
+		named := 0
+		for _, name := range regex.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if !model.LabelName(name).IsValidLegacy() {
+				return nil, fmt.Errorf("pid label rule %d: invalid label name %q", i, name)
+			}
+			named++
+		}
+		if named == 0 {
+			return nil, fmt.Errorf("pid label rule %d: regex %q has no named groups", i, rule.Regex)
+		}
+		l.rules = append(l.rules, regex)
+	}
+	return l, nil
+}
+
+// Labels returns the labels identifying the process that wrote pid
+func (l *PIDLabeler) Labels(pid string) map[string]string {
+	labels := make(map[string]string)
+	for _, rule := range l.rules {
+		match := rule.FindStringSubmatch(pid)
+		if match == nil {
+			continue
+		}
+		for i, name := range rule.SubexpNames() {
+			if name != "" && match[i] != "" {
+				labels[name] = match[i]
+			}
+		}
+		break
+	}
+	if len(labels) == 0 || l.keepPID {
+		labels["pid"] = pid
+	}
+	return labels
+}
+
+// pidLabelCache holds the labels of the pids one Collector has seen, as there
+// are few pids. Each Collector has its own, so that forgetting the pids it no
+// longer sees doesn't forget those of others sharing the PIDLabeler.
+type pidLabelCache struct {
+	labeler *PIDLabeler
+
+	mu     sync.Mutex
+	labels map[string]map[string]string // pid -> labels
+}
+
+func newPIDLabelCache(labeler *PIDLabeler) *pidLabelCache {
+	return &pidLabelCache{labeler: labeler, labels: make(map[string]map[string]string)}
+}
+
+// label returns the labels of each of pids, and forgets any other pids. Pids
+// whose labels are the same as another's, e.g. puma_1 and worker_id_1, would
+// have their series merged into one, so they are kept apart with their raw
+// pid label. Each group of them is returned as a collision. The returned maps
+// are shared and must not be modified.
+func (c *pidLabelCache) label(pids map[string]bool) (map[string]map[string]string, [][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pid := range c.labels {
+		if !pids[pid] {
+			delete(c.labels, pid)
+		}
+	}
+
+	byLabels := make(map[string][]string) // labels -> pids with them
+	for pid := range pids {
+		labels, ok := c.labels[pid]
+		if !ok {
+			labels = c.labeler.Labels(pid)
+			c.labels[pid] = labels
+		}
+		key := formatLabels(labels)
+		byLabels[key] = append(byLabels[key], pid)
+	}
+
+	result := make(map[string]map[string]string, len(pids))
+	var collisions [][]string
+	for _, key := range slices.Sorted(maps.Keys(byLabels)) {
+		group := byLabels[key]
+		for _, pid := range group {
+			labels := c.labels[pid]
+			if _, ok := labels["pid"]; len(group) > 1 && !ok {
+				labels = maps.Clone(labels)
+				labels["pid"] = pid
+			}
+			result[pid] = labels
+		}
+		if len(group) > 1 {
+			slices.Sort(group)
+			collisions = append(collisions, group)
+		}
+	}
+	return result, collisions
+}
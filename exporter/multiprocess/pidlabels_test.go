@@ -0,0 +1,152 @@
+package multiprocess
+
+import (
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPIDLabeler(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []PIDLabelRule
+		keepPID bool
+		pid     string
+		want    map[string]string
+	}{
+		{name: "process id", pid: "process_id_59891", want: map[string]string{"process_id": "59891"}},
+		{name: "unicorn and pitchfork workers", pid: "worker_id_3", want: map[string]string{"worker": "3"}},
+		{name: "puma worker", pid: "puma_2", want: map[string]string{"worker": "2"}},
+		{name: "python", pid: "4101", want: map[string]string{"process_id": "4101"}},
+		{name: "unknown", pid: "sidekiq_1", want: map[string]string{"pid": "sidekiq_1"}},
+		{name: "keep pid", keepPID: true, pid: "worker_id_3", want: map[string]string{"worker": "3", "pid": "worker_id_3"}},
+		{
+			name:  "configured rule",
+			rules: []PIDLabelRule{{Regex: `(?P<component>sidekiq)_(?P<worker>\d+)`}},
+			pid:   "sidekiq_1",
+			want:  map[string]string{"component": "sidekiq", "worker": "1"},
+		},
+		{
+			name:  "configured rules come first",
+			rules: []PIDLabelRule{{Regex: `worker_id_(?P<slot>\d+)`}},
+			pid:   "worker_id_3",
+			want:  map[string]string{"slot": "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labeler, err := NewPIDLabeler(tt.rules, tt.keepPID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := labeler.Labels(tt.pid); !maps.Equal(got, tt.want) {
+				t.Errorf("Labels(%q) = %v, want %v", tt.pid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPIDLabeler_Invalid(t *testing.T) {
+	for _, regex := range []string{`worker_(\d+)`, `worker_(?P<worker>\d+`, `worker_(?P<worker-id>\d+)`} {
+		if _, err := NewPIDLabeler([]PIDLabelRule{{Regex: regex}}, false); err == nil {
+			t.Errorf("expected an error for %q", regex)
+		}
+	}
+}
+
+func TestCollector_PIDLabels(t *testing.T) {
+	dir := t.TempDir()
+	for _, pid := range []string{"worker_id_3", "puma_1", "process_id_59891", "sidekiq_2"} {
+		writeDB(t, filepath.Join(dir, "gauge_all_"+pid+"-0.db"),
+			testEntry{key: `["memory_bytes","memory_bytes",[],[]]`, value: 100},
+		)
+	}
+	labeler, err := NewPIDLabeler([]PIDLabelRule{{Regex: `sidekiq_(?P<sidekiq_worker>\d+)`}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP memory_bytes Multiprocess metric
+# TYPE memory_bytes gauge
+memory_bytes{pid="process_id_59891",process_id="59891"} 100
+memory_bytes{pid="puma_1",worker="1"} 100
+memory_bytes{pid="sidekiq_2",sidekiq_worker="2"} 100
+memory_bytes{pid="worker_id_3",worker="3"} 100
+`
+	collector := NewCollector(dir, WithLiveness(allAlive), WithPIDLabeler(labeler))
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
+
+func TestCollector_PIDLabelsCollide(t *testing.T) {
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "gauge_all_worker_id_3-0.db"),
+		testEntry{key: `["sidekiq_jobs_running","sidekiq_jobs_running",["worker"],["HardJob"]]`, value: 2},
+		testEntry{key: `["sidekiq_jobs_running","sidekiq_jobs_running",["worker"],["EasyJob"]]`, value: 5},
+	)
+	writeDB(t, filepath.Join(dir, "gauge_all_sidekiq_1-0.db"),
+		testEntry{key: `["sidekiq_jobs_running","sidekiq_jobs_running",["pid","exported_pid"],["1","2"]]`, value: 1},
+	)
+
+	// The application's labels are kept, and pid labels of the same name are
+	// prefixed until they are unique
+	expected := `
+# HELP sidekiq_jobs_running Multiprocess metric
+# TYPE sidekiq_jobs_running gauge
+sidekiq_jobs_running{exported_exported_pid="sidekiq_1",exported_pid="2",pid="1"} 1
+sidekiq_jobs_running{exported_worker="3",worker="EasyJob"} 5
+sidekiq_jobs_running{exported_worker="3",worker="HardJob"} 2
+`
+	collector := NewCollector(dir, WithLiveness(allAlive))
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
+
+func TestCollector_PIDLabelsSame(t *testing.T) {
+	dir := t.TempDir()
+	for pid, value := range map[string]float64{"worker_id_1": 100, "puma_1": 200, "puma_2": 300} {
+		writeDB(t, filepath.Join(dir, "gauge_all_"+pid+"-0.db"),
+			testEntry{key: `["memory_bytes","memory_bytes",[],[]]`, value: value},
+		)
+	}
+
+	// worker_id_1 and puma_1 are both worker 1, so they keep their pid label
+	// rather than being served as one series
+	expected := `
+# HELP memory_bytes Multiprocess metric
+# TYPE memory_bytes gauge
+memory_bytes{pid="puma_1",worker="1"} 200
+memory_bytes{pid="worker_id_1",worker="1"} 100
+memory_bytes{worker="2"} 300
+`
+	collector := NewCollector(dir, WithLiveness(allAlive))
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
+
+func TestCollector_SharedPIDLabeler(t *testing.T) {
+	web, karafka := t.TempDir(), t.TempDir()
+	writeDB(t, filepath.Join(web, "gauge_all_puma_1-0.db"),
+		testEntry{key: `["memory_bytes","memory_bytes",[],[]]`, value: 100},
+	)
+	writeDB(t, filepath.Join(karafka, "gauge_all_process_id_7-0.db"),
+		testEntry{key: `["memory_bytes","memory_bytes",[],[]]`, value: 200},
+	)
+
+	// Each collector forgets only the pids it no longer sees itself
+	labeler := defaultPIDLabeler()
+	webCollector := NewCollector(web, WithLiveness(allAlive), WithPIDLabeler(labeler))
+	karafkaCollector := NewCollector(karafka, WithLiveness(allAlive), WithPIDLabeler(labeler))
+	testutil.CollectAndCount(webCollector)
+	testutil.CollectAndCount(karafkaCollector)
+	if _, ok := webCollector.pidLabels.labels["puma_1"]; !ok {
+		t.Error("expected web's pid labels to be kept when karafka is collected")
+	}
+}
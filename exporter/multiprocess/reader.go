@@ -0,0 +1,256 @@
+package multiprocess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"slices"
+	"time"
+)
+
+// Reader reads the entries of one multiprocess file, without merging them
+// with other files.
+//
+// Entries reads the file afresh each time it is called. The Collector keeps
+// a Reader for each file between scrapes and hands it the file's mapping
+// instead, so that it decodes only the entries appended since the last scrape
+// and re-reads the values of the rest.
+type Reader struct {
+	info     *FileInfo
+	r        io.ReaderAt
+	size     int64
+	modified time.Time
+	closer   io.Closer
+	buf      []byte // reused between reads of the file
+
+	used    int // position after the last decoded entry
+	held    int // position of an entry held back to retry, once it's been reported
+	entries []Entry
+	layout  *layout // detected from the first entries decoded
+}
+
+// Open opens the multiprocess file at path. Its type, mode and pid come from
+// the filename, which must follow one of the dialects' naming conventions.
+func Open(path string) (*Reader, error) {
+	info, err := ParseFilename(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := newReader(info, f, stat.Size())
+	r.modified = stat.ModTime()
+	r.closer = f
+	return r, nil
+}
+
+// NewReader reads a multiprocess file of size bytes from r. name is the file's
+// name, which entries' type, mode and pid are parsed from.
+func NewReader(r io.ReaderAt, size int64, name string) (*Reader, error) {
+	info, err := ParseFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(info, r, size), nil
+}
+
+func newReader(info *FileInfo, r io.ReaderAt, size int64) *Reader {
+	return &Reader{info: info, r: r, size: size, used: headerSize}
+}
+
+// Info returns the metadata parsed from the file's name
+func (r *Reader) Info() FileInfo {
+	info := *r.info
+	info.Data = nil
+	return info
+}
+
+// Entries reads the file and yields each of its entries, in the order they
+// are stored. An entry that can't be decoded is yielded in its place as an
+// *EntryError with a zero Entry, and reading carries on with the next. If
+// the file can't be read at all, that error is the only one yielded.
+//
+// Histogram buckets are yielded cumulatively, as /metrics serves them: the
+// buckets of files whose dialect stores each bucket's own observations are
+// accumulated, and followed by the _count they imply if the file has none.
+func (r *Reader) Entries() iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		// Start over, so entries that can't be decoded are yielded every time
+		r.reset()
+		entries, skipped, err := r.readUsed()
+		if err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		if !r.cumulative() {
+			entries = accumulateBuckets(entries)
+		}
+		for len(entries) > 0 || len(skipped) > 0 {
+			var entryErr *EntryError
+			if len(skipped) > 0 && (len(entries) == 0 ||
+				!errors.As(skipped[0], &entryErr) || entryErr.Offset < entries[0].offset) {
+				if !yield(Entry{}, skipped[0]) {
+					return
+				}
+				skipped = skipped[1:]
+				continue
+			}
+			if !yield(entries[0], nil) {
+				return
+			}
+			entries = entries[1:]
+		}
+	}
+}
+
+// readUsed reads the used part of the file, and no more, then decodes it
+func (r *Reader) readUsed() ([]Entry, []error, error) {
+	if r.size < 0 {
+		return nil, nil, fmt.Errorf("invalid size %d", r.size)
+	}
+	if r.size < headerSize {
+		return nil, nil, nil
+	}
+
+	if cap(r.buf) < headerSize {
+		r.buf = make([]byte, headerSize)
+	}
+	if _, err := r.r.ReadAt(r.buf[:headerSize], 0); err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", r.info.Path, err)
+	}
+	used, err := usedBytes(r.buf[:headerSize], int(r.size))
+	if err != nil {
+		return nil, nil, err
+	}
+	if cap(r.buf) < used {
+		r.buf = make([]byte, used)
+	}
+	data := r.buf[:used]
+	if n, err := r.r.ReadAt(data, 0); err != nil && !(err == io.EOF && n == used) {
+		return nil, nil, fmt.Errorf("reading %s: %w", r.info.Path, err)
+	}
+
+	entries, skipped, err := r.decode(data, used)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !r.modified.IsZero() {
+		stampEntries(entries, r.modified)
+	}
+	return entries, skipped, nil
+}
+
+// decode decodes the entries appended to data since the last call and reads
+// the values of all of them, returning every entry and the errors for the
+// newly appended ones that couldn't be decoded. data holds the file up to at
+// least used, its used header.
+func (r *Reader) decode(data []byte, used int) ([]Entry, []error, error) {
+	data = data[:used]
+	if used < r.used {
+		// The file was rewritten in place, so nothing decoded before can be trusted
+		r.reset()
+	}
+
+	var skipped []error
+	if r.layout == nil {
+		var (
+			l     layout
+			added []Entry
+			end   int
+		)
+		l, added, end, skipped = detectLayout(r.info, data, used)
+		if len(added) > 0 {
+			r.layout = &l
+		}
+		r.entries = added
+		r.used = end
+	} else {
+		var (
+			added []Entry
+			end   int
+		)
+		added, end, skipped = decodeEntries(r.info, *r.layout, data, r.used, used)
+		r.entries = append(r.entries, added...)
+		r.used = end
+	}
+	skipped = r.reportHeld(skipped, used)
+
+	for i := range r.entries {
+		value, err := readF64(data, r.entries[i].valueOffset)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: value at pos %d: %v", ErrCorruptedEntry, r.entries[i].valueOffset, err)
+		}
+		r.entries[i].Value = value
+
+		if offset := r.entries[i].timestampOffset; offset > 0 {
+			timestamp, err := readF64(data, offset)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: timestamp at pos %d: %v", ErrCorruptedEntry, offset, err)
+			}
+			r.entries[i].timestamp = timestamp
+		}
+	}
+
+	// Callers get their own copy, so they can't disturb what the Reader
+	// remembers. Label maps are shared and must be treated as read-only.
+	return slices.Clone(r.entries), skipped, nil
+}
+
+// cumulative reports whether the file's histogram buckets are stored
+// cumulatively, as Prometheus serves them. Until entries have been decoded
+// it is assumed they are.
+func (r *Reader) cumulative() bool {
+	return r.layout == nil || r.layout.dialect.cumulativeBuckets
+}
+
+// reportHeld drops the error for an entry decoding stopped before, as one
+// that may still be being written, if it was reported by an earlier decode
+func (r *Reader) reportHeld(skipped []error, used int) []error {
+	if r.used >= used {
+		r.held = 0
+		return skipped
+	}
+	if r.held == r.used && len(skipped) > 0 {
+		skipped = skipped[:len(skipped)-1]
+	}
+	r.held = r.used
+	return skipped
+}
+
+// reset forgets everything decoded from the file
+func (r *Reader) reset() {
+	r.used = headerSize
+	r.held = 0
+	r.entries = nil
+	r.layout = nil
+}
+
+// Close closes the file if the Reader opened it
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// stampEntries records when the file entries were read from was modified,
+// which is also the best guess at when values without a timestamp of their
+// own were written
+func stampEntries(entries []Entry, modified time.Time) {
+	mtime := float64(modified.UnixNano()) / float64(time.Second)
+	for i := range entries {
+		entries[i].modTime = mtime
+		if entries[i].timestampOffset == 0 {
+			entries[i].timestamp = mtime
+		}
+	}
+}
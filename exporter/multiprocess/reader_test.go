@@ -0,0 +1,267 @@
+package multiprocess
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	r, err := Open(filepath.Join("test_fixtures", "counter", "counter_process_id_673-0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if info := r.Info(); info.Type != "counter" || info.PID != "process_id_673" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	var entries []Entry
+	for entry, err := range r.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	first := entries[0]
+	if first.FamilyName != "widgets_created_total" || first.RawLabels()["type"] != "guinness" || first.Value != 150 || first.Offset() != 8 {
+		t.Errorf("unexpected first entry: %+v", first)
+	}
+	if first.Timestamp().IsZero() {
+		t.Error("expected the timestamp to default to the file's mtime")
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.db")
+	writeDB(t, path,
+		testEntry{`["requests","requests_bucket",["le"],["0.5"]]`, 1},
+		testEntry{`["requests","requests_bucket",["le"],["+Inf"]]`, 2},
+	)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(data), int64(len(data)), "histogram_process_id_1-0.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var les []string
+	for entry, err := range r.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Type != "histogram" || !entry.Timestamp().IsZero() {
+			t.Errorf("unexpected entry: %+v", entry)
+		}
+		les = append(les, entry.RawLabels()["le"])
+	}
+	if !slices.Equal(les, []string{"0.5", "+Inf"}) {
+		t.Errorf("expected the raw le labels, got %v", les)
+	}
+
+	if _, err := NewReader(bytes.NewReader(data), int64(len(data)), "invalid.db"); !errors.Is(err, ErrFilenameFormat) {
+		t.Errorf("expected ErrFilenameFormat, got %v", err)
+	}
+}
+
+func TestReader_AccumulatesBuckets(t *testing.T) {
+	// Written by prometheus_client, which stores each bucket's own
+	// observations and no _count
+	r, err := Open(filepath.Join("test_fixtures", "python", "histogram_4101.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var got []string
+	for entry, err := range r.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s%s %g", entry.MetricName, formatLabels(entry.RawLabels()), entry.Value))
+	}
+	expected := []string{
+		`request_latency_seconds_sum{} 2.35`,
+		`request_latency_seconds_bucket{le="0.1"} 1`,
+		`request_latency_seconds_bucket{le="0.5"} 2`,
+		`request_latency_seconds_bucket{le="1.0"} 2`,
+		`request_latency_seconds_bucket{le="+Inf"} 3`,
+		`request_latency_seconds_count{} 3`,
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected cumulative buckets and a count, got %q", got)
+	}
+}
+
+func TestReader_Errors(t *testing.T) {
+	valid := encodeEntry(testEntry{`["jobs","jobs",[],[]]`, 1})
+	overrun := slices.Clone(valid)
+	overrun[0] = 200
+	file := func(used int, entries ...[]byte) []byte {
+		data := make([]byte, headerSize)
+		for _, e := range entries {
+			data = append(data, e...)
+		}
+		data[0] = byte(used)
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		err    error
+		offset int
+	}{
+		{"used beyond the file", file(200, valid), ErrTruncated, -1},
+		{"key overruns the file", file(headerSize+len(valid), overrun), ErrCorruptedEntry, headerSize},
+		{"invalid key", file(headerSize+len(valid), bytes.Replace(valid, []byte("["), []byte("{"), 1)), ErrInvalidKey, headerSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tt.data), int64(len(tt.data)), "counter_process_id_1-0.db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var errs []error
+			for _, err := range r.Entries() {
+				errs = append(errs, err)
+			}
+			if len(errs) != 1 || !errors.Is(errs[0], tt.err) {
+				t.Fatalf("expected a single %v, got %v", tt.err, errs)
+			}
+			var entryErr *EntryError
+			if found := errors.As(errs[0], &entryErr); found != (tt.offset >= 0) {
+				t.Fatalf("expected an EntryError: %v, got %v", tt.offset >= 0, errs[0])
+			}
+			if entryErr != nil && entryErr.Offset != tt.offset {
+				t.Errorf("expected offset %d, got %d", tt.offset, entryErr.Offset)
+			}
+		})
+	}
+}
+
+func TestReader_SkipsCorruptedEntries(t *testing.T) {
+	entry := func(queue string) []byte {
+		return encodeEntry(testEntry{`["jobs","jobs",["queue"],["` + queue + `"]]`, 1})
+	}
+	torn := entry("torn")
+	binary.LittleEndian.PutUint32(torn, 0xffff_ffff) // a length that can't be trusted
+	var data []byte
+	data = append(data, make([]byte, headerSize)...)
+	for _, e := range [][]byte{
+		entry("default"),
+		encodeEntry(testEntry{`["jobs","jobs",["queue"],["unterminated]]`, 1}),
+		encodeEntry(testEntry{`["","",[],[]]`, 1}),
+		torn,
+		entry("mailers"),
+		encodeEntry(testEntry{`["latency","latency_bucket",["le"],["NaN"]]`, 1}),
+		entry("low"),
+	} {
+		data = append(data, e...)
+	}
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+
+	r, err := NewReader(bytes.NewReader(data), int64(len(data)), "counter_process_id_1-0.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for entry, err := range r.Entries() {
+		var entryErr *EntryError
+		switch {
+		case errors.As(err, &entryErr) && errors.Is(err, ErrInvalidKey):
+			got = append(got, "invalid key")
+		case errors.As(err, &entryErr) && errors.Is(err, ErrCorruptedEntry):
+			got = append(got, "corrupted")
+		case err != nil:
+			t.Fatalf("unexpected error: %v", err)
+		default:
+			got = append(got, entry.RawLabels()["queue"])
+		}
+	}
+	expected := []string{"default", "invalid key", "invalid key", "corrupted", "mailers", "invalid key", "low"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// boundedReaderAt fails reads past limit, like the unwritten end of a file
+// that isn't worth reading
+type boundedReaderAt struct {
+	r     io.ReaderAt
+	limit int64
+}
+
+func (b boundedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > b.limit {
+		return 0, fmt.Errorf("read of %d bytes at %d is past the used part of the file", len(p), off)
+	}
+	return b.r.ReadAt(p, off)
+}
+
+func TestReader_ReadsOnlyUsedBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.db")
+	writeDB(t, path, testEntry{`["jobs","jobs",[],[]]`, 3})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := int64(binary.LittleEndian.Uint32(data))
+
+	r, err := NewReader(boundedReaderAt{bytes.NewReader(data), used}, int64(len(data)), "counter_process_id_1-0.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		var values []float64
+		for entry, err := range r.Entries() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, entry.Value)
+		}
+		if !slices.Equal(values, []float64{3}) {
+			t.Errorf("expected the one entry every time, got %v", values)
+		}
+	}
+}
+
+func TestMergeAndGroup(t *testing.T) {
+	var all []Entry
+	for _, file := range []string{"histogram_process_id_1-0.db", "histogram_process_id_2-0.db"} {
+		path := filepath.Join(t.TempDir(), file)
+		writeDB(t, path,
+			testEntry{`["latency","latency_bucket",["le"],["1"]]`, 1},
+			testEntry{`["latency","latency_bucket",["le"],["+Inf"]]`, 2},
+			testEntry{`["latency","latency_count",[],[]]`, 2},
+		)
+		entries, _, err := readEntries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, entries...)
+	}
+
+	var groups [][]Entry
+	for group := range Group(Merge(all)) {
+		groups = append(groups, group)
+	}
+	if len(groups) != 1 || len(groups[0]) != 3 {
+		t.Fatalf("expected one group of 3 entries, got %v", groups)
+	}
+	for _, entry := range groups[0] {
+		if entry.MetricName == "latency_count" && entry.Value != 4 {
+			t.Errorf("expected counts to be summed, got %v", entry.Value)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package multiprocess
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Relabel actions, as in Prometheus metric_relabel_configs
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelMap  = "labelmap"
+)
+
+// nameLabel holds the family name while rules are applied
+const nameLabel = "__name__"
+
+// RelabelConfig is a single relabeling rule, modelled on Prometheus
+// metric_relabel_configs. Rules see an entry's labels plus __name__, which
+// holds the family name. The le label of histogram buckets is hidden from
+// rules so they can't break bucket layouts.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// Relabeler applies relabeling rules to entries before they are merged, so
+// aggregation happens on the relabeled identity.
+type Relabeler struct {
+	rules []relabelRule
+}
+
+// NewRelabeler validates and compiles configs, filling in the same defaults
+// as Prometheus.
+func NewRelabeler(configs []RelabelConfig) (*Relabeler, error) {
+	r := &Relabeler{}
+	for i, config := range configs {
+		rule := relabelRule{
+			sourceLabels: config.SourceLabels,
+			separator:    ";",
+			targetLabel:  config.TargetLabel,
+			replacement:  "$1",
+			action:       config.Action,
+		}
+		if rule.action == "" {
+			rule.action = RelabelReplace
+		}
+		if config.Separator != nil {
+			rule.separator = *config.Separator
+		}
+		if config.Replacement != nil {
+			rule.replacement = *config.Replacement
+		}
+		expr := "(.*)"
+		if config.Regex != nil {
+			expr = *config.Regex
+		}
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex %q: %w", i, expr, err)
+		}
+		rule.regex = regex
+
+		switch rule.action {
+		case RelabelReplace:
+			if rule.targetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: %s requires target_label", i, rule.action)
+			}
+			if rule.targetLabel != nameLabel && !model.LabelName(rule.targetLabel).IsValidLegacy() {
+				return nil, fmt.Errorf("relabel rule %d: invalid target_label %q", i, rule.targetLabel)
+			}
+		case RelabelKeep, RelabelDrop, RelabelLabelDrop, RelabelLabelMap:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, rule.action)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Relabel applies the rules to entry, returning the relabeled entry and
+// whether it should be kept.
+func (r *Relabeler) Relabel(entry Entry) (Entry, bool) {
+	if r == nil || len(r.rules) == 0 {
+		return entry, true
+	}
+
+	// Labels may be shared with the file cache, so work on a copy
+	labels := maps.Clone(entry.labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	le, hasLe := labels["le"]
+	delete(labels, "le")
+	labels[nameLabel] = entry.FamilyName
+
+	for _, rule := range r.rules {
+		if !rule.apply(labels) {
+			return entry, false
+		}
+	}
+
+	family := labels[nameLabel]
+	if family == "" {
+		return entry, false
+	}
+	delete(labels, nameLabel)
+	if hasLe {
+		labels["le"] = le
+	}
+
+	// Keep the _bucket, _count and _sum suffixes of the original metric name
+	entry.MetricName = family + strings.TrimPrefix(entry.MetricName, entry.FamilyName)
+	entry.FamilyName = family
+	entry.labels = labels
+	return entry, true
+}
+
+// apply runs a single rule on labels in place, reporting whether the entry is kept
+func (rule relabelRule) apply(labels map[string]string) bool {
+	switch rule.action {
+	case RelabelKeep:
+		return rule.regex.MatchString(rule.sourceValue(labels))
+	case RelabelDrop:
+		return !rule.regex.MatchString(rule.sourceValue(labels))
+	case RelabelReplace:
+		value := rule.sourceValue(labels)
+		match := rule.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		result := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+		if result == "" {
+			delete(labels, rule.targetLabel)
+		} else {
+			labels[rule.targetLabel] = result
+		}
+	case RelabelLabelDrop:
+		for name := range labels {
+			if name != nameLabel && rule.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case RelabelLabelMap:
+		// Iterate in a stable order so conflicting mappings resolve the same way every time
+		for _, name := range slices.Sorted(maps.Keys(labels)) {
+			if name == nameLabel || !rule.regex.MatchString(name) {
+				continue
+			}
+			// A replacement can make names that aren't valid labels, which
+			// would fail the whole scrape, so those aren't mapped
+			if mapped := rule.regex.ReplaceAllString(name, rule.replacement); model.LabelName(mapped).IsValidLegacy() {
+				labels[mapped] = labels[name]
+			}
+		}
+	}
+	return true
+}
+
+func (rule relabelRule) sourceValue(labels map[string]string) string {
+	values := make([]string, len(rule.sourceLabels))
+	for i, name := range rule.sourceLabels {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, rule.separator)
+}
@@ -0,0 +1,164 @@
+package multiprocess
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func ptr(s string) *string { return &s }
+
+func TestCollector_Relabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		configs  []RelabelConfig
+		expected string
+	}{
+		{
+			name:    "drop families",
+			fixture: "gauge",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__name__"}, Regex: ptr("(room|oven|water|boiler|thermostat)_.*"), Action: RelabelDrop},
+			},
+			expected: `
+# HELP greenhouse_temperature_celsius Multiprocess metric
+# TYPE greenhouse_temperature_celsius gauge
+greenhouse_temperature_celsius{greenhouse="inside"} 54.3
+# HELP outside_temperature_celsius Multiprocess metric
+# TYPE outside_temperature_celsius gauge
+outside_temperature_celsius{sensor="garden"} 10.9
+`,
+		},
+		{
+			name:    "keep series",
+			fixture: "gauge",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__name__", "room"}, Regex: ptr("room_temperature_celsius;(kitchen|lounge)"), Action: RelabelKeep},
+			},
+			expected: `
+# HELP room_temperature_celsius Multiprocess metric
+# TYPE room_temperature_celsius gauge
+room_temperature_celsius{room="kitchen"} 25.45
+room_temperature_celsius{room="lounge"} 22.4
+`,
+		},
+		{
+			name:    "rename a legacy metric",
+			fixture: "counter",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__name__"}, Regex: ptr("widgets_(.*)"), TargetLabel: "__name__", Replacement: ptr("gadgets_$1")},
+			},
+			expected: `
+# HELP gadgets_created_total Multiprocess metric
+# TYPE gadgets_created_total counter
+gadgets_created_total{type="guinness"} 250
+gadgets_created_total{type="murphys"} 61
+gadgets_created_total 30
+`,
+		},
+		{
+			name:    "replace into a new label",
+			fixture: "counter",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"type"}, Regex: ptr("g(.*)"), TargetLabel: "brand", Replacement: ptr("G$1")},
+			},
+			expected: `
+# HELP widgets_created_total Multiprocess metric
+# TYPE widgets_created_total counter
+widgets_created_total{brand="Guinness",type="guinness"} 250
+widgets_created_total{type="murphys"} 61
+widgets_created_total 30
+`,
+		},
+		{
+			name:    "labeldrop aggregates histograms on the remaining labels",
+			fixture: "histogram",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__name__"}, Regex: ptr("calculator_time_taken"), Action: RelabelKeep},
+				{Regex: ptr("operation|le"), Action: RelabelLabelDrop},
+			},
+			expected: `
+# HELP calculator_time_taken Multiprocess metric
+# TYPE calculator_time_taken histogram
+calculator_time_taken_bucket{le="0.25"} 4
+calculator_time_taken_bucket{le="0.5"} 7
+calculator_time_taken_bucket{le="1"} 10
+calculator_time_taken_bucket{le="2"} 12
+calculator_time_taken_bucket{le="4"} 15
+calculator_time_taken_bucket{le="+Inf"} 18
+calculator_time_taken_count 18
+calculator_time_taken_sum 36.5
+`,
+		},
+		{
+			name:    "labelmap",
+			fixture: "summary",
+			configs: []RelabelConfig{
+				{Regex: ptr("(method|path)"), Replacement: ptr("http_$1"), Action: RelabelLabelMap},
+				{Regex: ptr("method|path"), Action: RelabelLabelDrop},
+			},
+			expected: `
+# HELP api_client_http_timing Multiprocess metric
+# TYPE api_client_http_timing summary
+api_client_http_timing_count{http_method="get",http_path="/api/v1/users"} 6
+api_client_http_timing_sum{http_method="get",http_path="/api/v1/users"} 10.8
+`,
+		},
+		{
+			name:    "labelmap to invalid names",
+			fixture: "summary",
+			configs: []RelabelConfig{
+				{Regex: ptr("(method|path)"), Replacement: ptr("http-$1"), Action: RelabelLabelMap},
+			},
+			expected: `
+# HELP api_client_http_timing Multiprocess metric
+# TYPE api_client_http_timing summary
+api_client_http_timing_count{method="get",path="/api/v1/users"} 6
+api_client_http_timing_sum{method="get",path="/api/v1/users"} 10.8
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relabeler, err := NewRelabeler(tt.configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			collector := NewCollector(fixtureDir(t, tt.fixture),
+				WithLiveness(allAlive),
+				WithRelabeler(relabeler),
+			)
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected)); err != nil {
+				t.Errorf("CollectAndCompare failed: %v", err)
+			}
+
+			// Relabeling must not leak into the cached entries
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected)); err != nil {
+				t.Errorf("second CollectAndCompare failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewRelabeler_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RelabelConfig
+	}{
+		{name: "unknown action", config: RelabelConfig{Action: "hashmod"}},
+		{name: "invalid regex", config: RelabelConfig{Regex: ptr("("), Action: RelabelDrop}},
+		{name: "replace without target", config: RelabelConfig{SourceLabels: []string{"a"}}},
+		{name: "invalid target", config: RelabelConfig{SourceLabels: []string{"a"}, TargetLabel: "http-method"}},
+		{name: "target starting with a digit", config: RelabelConfig{SourceLabels: []string{"a"}, TargetLabel: "1st"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRelabeler([]RelabelConfig{tt.config}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
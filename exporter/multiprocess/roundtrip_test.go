@@ -0,0 +1,151 @@
+package multiprocess
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/errm/promenade/exporter/multiprocess/writer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// randomString returns a string that is awkward to encode: quotes,
+// backslashes, control characters and multibyte runes
+func randomString(r *rand.Rand, min int) string {
+	alphabet := []rune("abcXYZ_09 \"\\/\n\t\x00\x1féü日本🔥<>&")
+	var b strings.Builder
+	for range min + r.IntN(12) {
+		b.WriteRune(alphabet[r.IntN(len(alphabet))])
+	}
+	return b.String()
+}
+
+func randomValue(r *rand.Rand) float64 {
+	switch r.IntN(6) {
+	case 0:
+		return math.Inf(1 - 2*r.IntN(2))
+	case 1:
+		return math.NaN()
+	case 2:
+		return math.Float64frombits(r.Uint64())
+	case 3:
+		return 0
+	default:
+		return r.NormFloat64() * 1e6
+	}
+}
+
+func randomEntries(r *rand.Rand) []writer.Entry {
+	entries := make([]writer.Entry, r.IntN(20))
+	for i := range entries {
+		key := writer.Key{Family: randomString(r, 1)}
+		key.Metric = key.Family + randomString(r, 0)
+		names := make(map[string]bool)
+		for range r.IntN(4) {
+			name := randomString(r, 1)
+			if names[name] {
+				continue // Keys can't repeat a label name
+			}
+			names[name] = true
+			key.Labels = append(key.Labels, writer.Label{Name: name, Value: randomString(r, 0)})
+		}
+		entries[i] = writer.Entry{Key: key, Value: randomValue(r)}
+	}
+	return entries
+}
+
+func TestWriter_RoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	files := []struct{ typ, mode string }{
+		{"counter", ""},
+		{"gauge", "liveall"},
+		{"histogram", ""},
+		{"summary", ""},
+	}
+	for i := range 500 {
+		file := files[i%len(files)]
+		pid := fmt.Sprintf("process_id_%d", r.IntN(100000))
+		written := randomEntries(r)
+
+		name, err := writer.Filename(file.typ, file.mode, pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ParseFilename(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if info.Type != file.typ || info.MultiprocessMode != file.mode || info.PID != pid {
+			t.Fatalf("%s: parsed as %+v", name, info)
+		}
+
+		info.Data, err = writer.Encode(written...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := parseEntries(info)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(read) != len(written) {
+			t.Fatalf("%s: wrote %d entries, read %d", name, len(written), len(read))
+		}
+		for j, entry := range read {
+			want := written[j]
+			labels := make(map[string]string)
+			for _, label := range want.Key.Labels {
+				labels[label.Name] = label.Value
+			}
+			if entry.FamilyName != want.Key.Family || entry.MetricName != want.Key.Metric ||
+				!maps.Equal(entry.labels, labels) || math.Float64bits(entry.Value) != math.Float64bits(want.Value) {
+				t.Fatalf("%s: entry %d round-tripped as %+v, wrote %+v", name, j, entry, want)
+			}
+			if entry.Type != file.typ || entry.MultiprocessMode != file.mode || entry.PID != pid {
+				t.Fatalf("%s: entry %d has the wrong file metadata: %+v", name, j, entry)
+			}
+		}
+	}
+}
+
+func TestWriter_Collector(t *testing.T) {
+	dir := t.TempDir()
+	for _, pid := range []string{"process_id_1", "process_id_2"} {
+		f, err := writer.Create(dir, "counter", "", pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		key := writer.Key{Family: "jobs_total", Metric: "jobs_total", Labels: []writer.Label{{Name: "queue", Value: "default"}}}
+		if err := f.Add(key, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := writer.Create(dir, "gauge", "max", "process_id_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Set(writer.Key{Family: "queue_depth", Metric: "queue_depth"}, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.db")); len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", files)
+	}
+	collector := NewCollector(dir, WithLiveness(allAlive))
+	expected := `
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total{queue="default"} 4
+# HELP queue_depth Multiprocess metric
+# TYPE queue_depth gauge
+queue_depth 5
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("CollectAndCompare failed: %v", err)
+	}
+}
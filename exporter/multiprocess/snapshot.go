@@ -0,0 +1,150 @@
+package multiprocess
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// settleDelay is how long to wait after a change in the directory before
+// rebuilding, so a burst of changes (e.g. workers starting) causes one rebuild.
+const settleDelay = 100 * time.Millisecond
+
+const (
+	snapshotAgeName = "promenade_exporter_snapshot_age_seconds"
+	snapshotAgeHelp = "Time since the multiprocess metrics being served were read."
+)
+
+// snapshot is an immutable set of merged metrics
+type snapshot struct {
+	metrics []prometheus.Metric
+	built   time.Time
+}
+
+// SnapshotCollector serves the latest snapshot of a Collector's metrics, so
+// scrapes don't wait for files to be read.
+//
+// A background goroutine rebuilds the snapshot when files are added to or
+// removed from the directory, which is watched with inotify where it is
+// available. Values written through a mapping don't generate inotify events,
+// so the snapshot is also rebuilt every interval.
+type SnapshotCollector struct {
+	collector *Collector
+	interval  time.Duration
+	ageDesc   *prometheus.Desc
+	watcher   *dirWatcher
+	snapshot  atomic.Pointer[snapshot]
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewSnapshotCollector builds a first snapshot of collector's metrics, then
+// starts rebuilding it in the background at least every interval.
+func NewSnapshotCollector(collector *Collector, interval time.Duration) (*SnapshotCollector, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("snapshot interval must be positive, got %s", interval)
+	}
+	c := &SnapshotCollector{
+		collector: collector,
+		interval:  interval,
+		ageDesc: prometheus.NewDesc(
+			snapshotAgeName, snapshotAgeHelp,
+			nil, ageLabels(collector),
+		),
+		done: make(chan struct{}),
+	}
+	watcher, err := newDirWatcher(collector.dir)
+	if err != nil {
+		log.Printf("Not watching %s for changes, rebuilding snapshots every %s: %v", collector.dir, interval, err)
+	} else {
+		c.watcher = watcher
+	}
+	c.rebuild()
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// run is the background goroutine that rebuilds the snapshot.
+func (c *SnapshotCollector) run() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	var changes <-chan struct{}
+	if c.watcher != nil {
+		changes = c.watcher.changes
+	}
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-changes:
+			if settled == nil {
+				settled = time.After(settleDelay)
+			}
+		case <-settled:
+			settled = nil
+			c.rebuild()
+		case <-ticker.C:
+			c.rebuild()
+		}
+	}
+}
+
+// rebuild reads the directory and replaces the snapshot
+func (c *SnapshotCollector) rebuild() {
+	start := time.Now()
+	metrics := c.collector.gather()
+	c.snapshot.Store(&snapshot{metrics: metrics, built: time.Now()})
+	c.collector.metrics.snapshotRebuildDuration.Observe(time.Since(start).Seconds())
+}
+
+// Describe implements prometheus.Collector. Like Collector, it is unchecked.
+func (c *SnapshotCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector, serving the latest snapshot.
+func (c *SnapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.snapshot.Load()
+	for _, metric := range s.metrics {
+		ch <- metric
+	}
+	ch <- prometheus.MustNewConstMetric(c.ageDesc, prometheus.GaugeValue, time.Since(s.built).Seconds())
+}
+
+// ageLabels labels the snapshot age with the directory as well as the
+// collector's labels, so the ages of directories without labels of their own
+// don't collide
+func ageLabels(collector *Collector) prometheus.Labels {
+	labels := maps.Clone(collector.constLabels)
+	if labels == nil {
+		labels = make(prometheus.Labels)
+	}
+	labels["dir"] = collector.dir
+	return labels
+}
+
+// Units returns the units declared for the families in the latest snapshot
+func (c *SnapshotCollector) Units() map[string]string {
+	return c.collector.Units()
+}
+
+// Close stops the background goroutine. The last snapshot is still served.
+func (c *SnapshotCollector) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		if c.watcher != nil {
+			err = c.watcher.Close()
+		}
+	})
+	return err
+}
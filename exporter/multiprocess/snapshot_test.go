@@ -0,0 +1,127 @@
+package multiprocess
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const jobsExpected = `
+# HELP jobs_total Multiprocess metric
+# TYPE jobs_total counter
+jobs_total %s
+`
+
+// eventually retries check until it succeeds or a few seconds have passed
+func eventually(t *testing.T, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func compareJobs(collector prometheus.Collector, value string) error {
+	expected := fmt.Sprintf(jobsExpected, value)
+	return testutil.CollectAndCompare(collector, strings.NewReader(expected), "jobs_total")
+}
+
+func TestSnapshotCollector_RebuildsOnChange(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only available on Linux")
+	}
+	dir := t.TempDir()
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"),
+		testEntry{key: `["jobs","jobs_total",[],[]]`, value: 1},
+	)
+
+	// The interval is long enough that only the watcher can trigger a rebuild
+	collector, err := NewSnapshotCollector(NewCollector(dir, WithLiveness(allAlive)), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	if err := compareJobs(collector, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeDB(t, filepath.Join(dir, "counter_process_id_2-0.db"),
+		testEntry{key: `["jobs","jobs_total",[],[]]`, value: 2},
+	)
+	eventually(t, func() error { return compareJobs(collector, "3") })
+}
+
+func TestSnapshotCollector_RebuildsPeriodically(t *testing.T) {
+	// The directory doesn't exist yet, so it can't be watched
+	dir := filepath.Join(t.TempDir(), "missing")
+	collector, err := NewSnapshotCollector(NewCollector(dir, WithLiveness(allAlive)), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	if got := testutil.CollectAndCount(collector, "jobs_total"); got != 0 {
+		t.Fatalf("expected no metrics, got %d", got)
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeDB(t, filepath.Join(dir, "counter_process_id_1-0.db"),
+		testEntry{key: `["jobs","jobs_total",[],[]]`, value: 1},
+	)
+	eventually(t, func() error { return compareJobs(collector, "1") })
+}
+
+func TestSnapshotCollector_Close(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter_process_id_1-0.db")
+	writeDB(t, path, testEntry{key: `["jobs","jobs_total",[],[]]`, value: 1})
+
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	collector, err := NewSnapshotCollector(NewCollector(dir, WithLiveness(allAlive), WithMetrics(metrics)), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collector.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := collector.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	// The last snapshot is still served, but no longer rebuilt
+	setValue(t, path, 0, 5)
+	time.Sleep(50 * time.Millisecond)
+	if err := compareJobs(collector, "1"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.CollectAndCount(collector, "promenade_exporter_snapshot_age_seconds"); got != 1 {
+		t.Errorf("expected a snapshot age metric, got %d", got)
+	}
+	if got := testutil.CollectAndCount(reg, "promenade_exporter_snapshot_rebuild_duration_seconds"); got != 1 {
+		t.Errorf("expected a rebuild duration metric, got %d", got)
+	}
+}
+
+func TestNewSnapshotCollector_InvalidInterval(t *testing.T) {
+	if _, err := NewSnapshotCollector(NewCollector(t.TempDir()), 0); err == nil {
+		t.Error("expected an error for a zero interval")
+	}
+}
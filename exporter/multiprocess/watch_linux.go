@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package multiprocess
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// dirWatcher signals changes to the entries of a directory using inotify
+type dirWatcher struct {
+	file    *os.File
+	changes chan struct{}
+	wg      sync.WaitGroup
+}
+
+// watchEvents are the events that change which files exist or what they
+// contain, other than through a mapping.
+const watchEvents = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialise inotify: %w", err)
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, watchEvents); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not watch directory: %w", err)
+	}
+
+	// A non-blocking file is read through the runtime poller, so closing it
+	// unblocks the reader.
+	w := &dirWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan struct{}, 1),
+	}
+	w.wg.Add(1)
+	go w.read()
+	return w, nil
+}
+
+// read signals a change for every batch of events, without blocking if the
+// last change hasn't been handled yet.
+func (w *dirWatcher) read() {
+	defer w.wg.Done()
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops watching the directory
+func (w *dirWatcher) Close() error {
+	err := w.file.Close()
+	w.wg.Wait()
+	return err
+}
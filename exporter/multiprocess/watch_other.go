@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package multiprocess
+
+import "errors"
+
+// dirWatcher is not supported on non-Linux platforms, so snapshots are only
+// rebuilt periodically.
+type dirWatcher struct {
+	changes chan struct{}
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
+
+func (w *dirWatcher) Close() error { return nil }
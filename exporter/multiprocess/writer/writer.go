@@ -0,0 +1,245 @@
+// Package writer writes metrics in the multiprocess .db format read by the
+// exporter, byte for byte the way prometheus-client-mmap does. It lets Go
+// processes publish metrics through the same directory as Ruby ones, and
+// tests build fixtures without a Ruby toolchain.
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// headerSize is the used header followed by padding to 8 bytes
+	headerSize = 8
+	// initialSize is the size prometheus-client-mmap creates files with.
+	// Bytes past the used header are zero.
+	initialSize = 16384
+)
+
+// Metric types, as they appear in filenames
+var types = []string{"counter", "gauge", "histogram", "summary"}
+
+// Label is one label of an entry. Labels are written in the order given.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Key identifies an entry within a file: the family it belongs to, the name
+// of the sample, e.g. a histogram's family_bucket, and its labels.
+type Key struct {
+	Family string
+	Metric string
+	Labels []Label
+}
+
+// Entry is a key and its value
+type Entry struct {
+	Key   Key
+	Value float64
+}
+
+// Filename returns the name prometheus-client-mmap gives the file of a
+// process's metrics of one type: <type>_<pid>-0.db, or
+// gauge_<mode>_<pid>-0.db for gauges, which are the only type with a mode.
+func Filename(typ, mode, pid string) (string, error) {
+	if !slices.Contains(types, typ) {
+		return "", fmt.Errorf("unknown metric type %q, expected one of %s", typ, strings.Join(types, ", "))
+	}
+	if pid == "" || strings.Contains(pid, "-") {
+		return "", fmt.Errorf("invalid pid %q: must be non-empty and not contain -", pid)
+	}
+	if typ != "gauge" {
+		if mode != "" {
+			return "", fmt.Errorf("only gauges have a multiprocess mode, got %q for a %s", mode, typ)
+		}
+		return fmt.Sprintf("%s_%s-0.db", typ, pid), nil
+	}
+	if mode == "" || strings.ContainsAny(mode, "_-") {
+		return "", fmt.Errorf("invalid gauge mode %q: must be non-empty and not contain _ or -", mode)
+	}
+	return fmt.Sprintf("gauge_%s_%s-0.db", mode, pid), nil
+}
+
+// encodeKey encodes key as the JSON prometheus-client-mmap writes:
+// [family, metric, [label names], [label values]], without spaces
+func encodeKey(key Key) ([]byte, error) {
+	if key.Family == "" || key.Metric == "" {
+		return nil, errors.New("family and metric names must not be empty")
+	}
+	names := make([]string, len(key.Labels))
+	values := make([]string, len(key.Labels))
+	for i, label := range key.Labels {
+		if label.Name == "" {
+			return nil, fmt.Errorf("empty label name in %s", key.Metric)
+		}
+		names[i], values[i] = label.Name, label.Value
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // Ruby's generator doesn't escape <, > and &
+	if err := enc.Encode([]any{key.Family, key.Metric, names, values}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// paddingLen is the number of spaces after a key that align its value to 8
+// bytes. An aligned key is still followed by 8.
+func paddingLen(keyLen int) int {
+	return 8 - (4+keyLen)%8
+}
+
+// appendEntry appends an encoded key and its value to buf, returning it and
+// the offset of the value within it
+func appendEntry(buf, key []byte, value float64) ([]byte, int) {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, bytes.Repeat([]byte(" "), paddingLen(len(key)))...)
+	valueOffset := len(buf)
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(value)), valueOffset
+}
+
+// Encode returns the contents of a file holding entries, in order, the same
+// size as prometheus-client-mmap would create it
+func Encode(entries ...Entry) ([]byte, error) {
+	data := make([]byte, headerSize)
+	for _, entry := range entries {
+		key, err := encodeKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		data, _ = appendEntry(data, key, entry.Value)
+	}
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	if len(data) < initialSize {
+		data = append(data, make([]byte, initialSize-len(data))...)
+	}
+	return data, nil
+}
+
+// File is a .db file being written by this process. Values are updated in
+// place, and new entries are written before the used header is moved past
+// them, so readers never see a partial entry. It is safe for concurrent use.
+type File struct {
+	mu     sync.Mutex
+	f      *os.File
+	used   int
+	size   int
+	values map[string]int     // encoded key -> offset of its value
+	cache  map[string]float64 // encoded key -> its value, for Add
+}
+
+// Create creates the file for a process's metrics of one type in dir, named
+// by Filename. An existing file is truncated.
+func Create(dir, typ, mode, pid string) (*File, error) {
+	name, err := Filename(typ, mode, pid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{
+		f:      f,
+		used:   headerSize,
+		values: make(map[string]int),
+		cache:  make(map[string]float64),
+	}
+	if err := file.grow(initialSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := file.writeUsed(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Path returns the path of the file
+func (f *File) Path() string {
+	return f.f.Name()
+}
+
+// Set sets the value of key, adding it to the file if it is new
+func (f *File) Set(key Key, value float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.set(key, func(float64) float64 { return value })
+}
+
+// Add adds delta to the value of key, which starts at 0
+func (f *File) Add(key Key, delta float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.set(key, func(value float64) float64 { return value + delta })
+}
+
+func (f *File) set(key Key, update func(float64) float64) error {
+	encoded, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	k := string(encoded)
+	value := update(f.cache[k])
+
+	if offset, ok := f.values[k]; ok {
+		if _, err := f.f.WriteAt(binary.LittleEndian.AppendUint64(nil, math.Float64bits(value)), int64(offset)); err != nil {
+			return err
+		}
+		f.cache[k] = value
+		return nil
+	}
+
+	entry, valueOffset := appendEntry(nil, encoded, value)
+	if f.used+len(entry) > f.size {
+		// Double like prometheus-client-mmap does, so files don't grow often
+		size := f.size
+		for f.used+len(entry) > size {
+			size *= 2
+		}
+		if err := f.grow(size); err != nil {
+			return err
+		}
+	}
+	if _, err := f.f.WriteAt(entry, int64(f.used)); err != nil {
+		return err
+	}
+	f.values[k] = f.used + valueOffset
+	f.cache[k] = value
+	f.used += len(entry)
+	return f.writeUsed()
+}
+
+// grow extends the file to size bytes, which are zero
+func (f *File) grow(size int) error {
+	if err := f.f.Truncate(int64(size)); err != nil {
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+// writeUsed writes the used header
+func (f *File) writeUsed() error {
+	_, err := f.f.WriteAt(binary.LittleEndian.AppendUint32(nil, uint32(f.used)), 0)
+	return err
+}
+
+// Close closes the file. Its values stay in the directory until it is removed.
+func (f *File) Close() error {
+	return f.f.Close()
+}
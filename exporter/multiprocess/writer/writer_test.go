@@ -0,0 +1,125 @@
+package writer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncode_MatchesRubyClient(t *testing.T) {
+	expected, err := os.ReadFile(filepath.Join("..", "test_fixtures", "counter", "counter_process_id_673-0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Encode(
+		Entry{Key{"widgets_created_total", "widgets_created_total", []Label{{"type", "guinness"}}}, 150},
+		Entry{Key{"widgets_created_total", "widgets_created_total", []Label{{"type", "murphys"}}}, 10},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("encoded file differs from the one written by prometheus-client-mmap")
+	}
+}
+
+func TestFilename(t *testing.T) {
+	tests := []struct {
+		typ, mode, pid string
+		expected       string
+	}{
+		{"counter", "", "process_id_1", "counter_process_id_1-0.db"},
+		{"gauge", "livesum", "worker_id_3", "gauge_livesum_worker_id_3-0.db"},
+		{"histogram", "", "42", "histogram_42-0.db"},
+		{"untyped", "", "1", ""},
+		{"counter", "max", "1", ""},
+		{"gauge", "", "1", ""},
+		{"gauge", "live_sum", "1", ""},
+		{"counter", "", "", ""},
+		{"counter", "", "puma-1", ""},
+	}
+	for _, tt := range tests {
+		name, err := Filename(tt.typ, tt.mode, tt.pid)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("Filename(%q, %q, %q): expected an error, got %q", tt.typ, tt.mode, tt.pid, name)
+			}
+			continue
+		}
+		if err != nil || name != tt.expected {
+			t.Errorf("Filename(%q, %q, %q) = %q, %v; expected %q", tt.typ, tt.mode, tt.pid, name, err, tt.expected)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Create(dir, "counter", "", "process_id_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Path() != filepath.Join(dir, "counter_process_id_1-0.db") {
+		t.Errorf("unexpected path %s", f.Path())
+	}
+
+	key := func(queue string) Key {
+		return Key{"jobs_total", "jobs_total", []Label{{"queue", queue}}}
+	}
+	var expected []Entry
+	for _, queue := range []string{"default", "mailers"} {
+		if err := f.Add(key(queue), 1); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, Entry{key(queue), 1})
+	}
+	if err := f.Add(key("default"), 2); err != nil {
+		t.Fatal(err)
+	}
+	expected[0].Value = 3
+	if err := f.Set(key("mailers"), 7); err != nil {
+		t.Fatal(err)
+	}
+	expected[1].Value = 7
+
+	assertContents := func() {
+		t.Helper()
+		data, err := os.ReadFile(f.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := Encode(expected...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) < len(want) {
+			want = want[:len(data)]
+		}
+		if !bytes.Equal(data[:len(want)], want) {
+			t.Errorf("file contents differ from the encoded entries")
+		}
+	}
+	assertContents()
+
+	// Files double when they run out of room
+	for i := range 500 {
+		queue := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		if err := f.Set(key(queue), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, Entry{key(queue), float64(i)})
+	}
+	stat, err := os.Stat(f.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != 2*initialSize {
+		t.Errorf("expected the file to double to %d bytes, got %d", 2*initialSize, stat.Size())
+	}
+	assertContents()
+
+	if err := f.Set(Key{Family: "jobs_total"}, 1); err == nil {
+		t.Error("expected an error for a key without a metric name")
+	}
+}
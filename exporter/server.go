@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// listenAndServe serves srv on l. TLS and basic auth are configured by the
+// web config file, in the Prometheus exporter-toolkit format, if there is
+// one. The file is read again for each new connection, so renewed
+// certificates are served without a restart.
+func listenAndServe(srv *http.Server, l net.Listener, webConfigFile string) error {
+	return web.Serve(l, srv, &web.FlagConfig{WebConfigFile: &webConfigFile}, slog.Default())
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// certificate is a self-signed certificate and its key, for the server or a
+// client
+type certificate struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func selfSigned(t *testing.T, serial int64, usage x509.ExtKeyUsage) certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "promenade"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c certificate) keyPair(t *testing.T) tls.Certificate {
+	t.Helper()
+	pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startServer serves a handler that writes "ok" with the web config, and
+// returns its address
+func startServer(t *testing.T, webConfigFile string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go listenAndServe(srv, l, webConfigFile)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// get requests url on a new connection, so the server's certificate is
+// loaded again
+func get(client *tls.Config, url, user, password string) (*http.Response, error) {
+	transport := &http.Transport{TLSClientConfig: client, DisableKeepAlives: true}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestListenAndServe_Plain(t *testing.T) {
+	addr := startServer(t, "")
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 without a web config, got %d", resp.StatusCode)
+	}
+}
+
+func TestListenAndServe_BasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	server := selfSigned(t, 1, x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "server.crt"), server.certPEM)
+	writeFile(t, filepath.Join(dir, "server.key"), server.keyPEM)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webConfig := filepath.Join(dir, "web.yml")
+	writeFile(t, webConfig, []byte(`tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+basic_auth_users:
+  prometheus: `+string(hash)+"\n"))
+
+	addr := startServer(t, webConfig)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	client := &tls.Config{RootCAs: roots}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		status   int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "prometheus", "guess", http.StatusUnauthorized},
+		{"unknown user", "grafana", "secret", http.StatusUnauthorized},
+		{"valid", "prometheus", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := get(client, "https://"+addr+"/metrics", tt.user, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected plain HTTP to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestListenAndServe_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	server := selfSigned(t, 1, x509.ExtKeyUsageServerAuth)
+	client := selfSigned(t, 2, x509.ExtKeyUsageClientAuth)
+	stranger := selfSigned(t, 3, x509.ExtKeyUsageClientAuth)
+	writeFile(t, filepath.Join(dir, "server.crt"), server.certPEM)
+	writeFile(t, filepath.Join(dir, "server.key"), server.keyPEM)
+	writeFile(t, filepath.Join(dir, "client_ca.crt"), client.certPEM)
+	webConfig := filepath.Join(dir, "web.yml")
+	writeFile(t, webConfig, []byte(`tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_ca_file: client_ca.crt
+  client_auth_type: RequireAndVerifyClientCert
+  min_version: TLS13
+`))
+
+	addr := startServer(t, webConfig)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	tests := []struct {
+		name   string
+		client *tls.Config
+		ok     bool
+	}{
+		{"no certificate", &tls.Config{RootCAs: roots}, false},
+		{"untrusted certificate", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{stranger.keyPair(t)}}, false},
+		{"old TLS version", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.keyPair(t)}, MaxVersion: tls.VersionTLS12}, false},
+		{"trusted certificate", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.keyPair(t)}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := get(tt.client, "https://"+addr+"/metrics", "", "")
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("expected 200, got %d", resp.StatusCode)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("expected the connection to be refused, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestListenAndServe_ReloadsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	first := selfSigned(t, 1, x509.ExtKeyUsageServerAuth)
+	second := selfSigned(t, 2, x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "server.crt"), first.certPEM)
+	writeFile(t, filepath.Join(dir, "server.key"), first.keyPEM)
+	webConfig := filepath.Join(dir, "web.yml")
+	writeFile(t, webConfig, []byte(`tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+`))
+
+	addr := startServer(t, webConfig)
+	roots := x509.NewCertPool()
+	roots.AddCert(first.cert)
+	roots.AddCert(second.cert)
+	client := &tls.Config{RootCAs: roots}
+
+	resp, err := get(client, "https://"+addr+"/metrics", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber; serial.Int64() != 1 {
+		t.Errorf("expected the first certificate, got serial %s", serial)
+	}
+
+	// Renewing the certificate takes effect on the next connection
+	writeFile(t, filepath.Join(dir, "server.crt"), second.certPEM)
+	writeFile(t, filepath.Join(dir, "server.key"), second.keyPEM)
+	resp, err = get(client, "https://"+addr+"/metrics", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber; serial.Int64() != 2 {
+		t.Errorf("expected the renewed certificate, got serial %s", serial)
+	}
+}
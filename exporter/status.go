@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// collectorInfo describes an active collector on the landing page
+type collectorInfo struct {
+	Name        string
+	Description string
+}
+
+// configEntry is a flag and its effective value, for the landing page
+type configEntry struct {
+	Flag  string
+	Value string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<h3>Collectors</h3>
+<ul>
+{{- range .Collectors}}
+<li><b>{{.Name}}</b>: {{.Description}}</li>
+{{- end}}
+</ul>
+<h3>Configuration</h3>
+<table>
+{{- range .Config}}
+<tr><td><code>{{.Flag}}</code></td><td><code>{{.Value}}</code></td></tr>
+{{- end}}
+</table>
+`))
+
+// healthyHandler serves /-/healthy, which succeeds as long as the exporter
+// is serving at all
+func healthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Promenade exporter is Healthy.\n")
+	})
+}
+
+// readyHandler serves /-/ready, which fails with 503 and the reasons while
+// any of checks returns an error
+func readyHandler(checks ...func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var errs []error
+		for _, check := range checks {
+			if err := check(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			http.Error(w, "Promenade exporter is not ready:\n"+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "Promenade exporter is Ready.\n")
+	})
+}
+
+// dirsExist is a readiness check that each multiprocess directory exists,
+// and each glob matches one, as they won't until the application has started
+// when they share a volume
+func dirsExist(dirs []multiprocessDir) func() error {
+	return func() error {
+		for _, dir := range dirs {
+			if isGlob(dir.path) {
+				if len(matchDirs(dir.path)) == 0 {
+					return fmt.Errorf("multiprocess dir glob %s matched no directories", dir.path)
+				}
+				continue
+			}
+			stat, err := os.Stat(dir.path)
+			if err != nil {
+				return fmt.Errorf("multiprocess dir %s: %w", dir.path, err)
+			}
+			if !stat.IsDir() {
+				return fmt.Errorf("multiprocess dir %s is not a directory", dir.path)
+			}
+		}
+		return nil
+	}
+}
+
+// landingPage serves / with links to the other endpoints, the active
+// collectors and the effective configuration
+func landingPage(collectors []collectorInfo, config []configEntry) (http.Handler, error) {
+	var extra strings.Builder
+	if err := statusTemplate.Execute(&extra, struct {
+		Collectors []collectorInfo
+		Config     []configEntry
+	}{collectors, config}); err != nil {
+		return nil, err
+	}
+	return web.NewLandingPage(web.LandingConfig{
+		Name:        "Promenade exporter",
+		Description: "Prometheus metrics from Ruby and Python multiprocess applications",
+		Links: []web.LandingLinks{
+			{Address: "/metrics", Text: "Metrics"},
+			{Address: "/-/healthy", Text: "Health"},
+			{Address: "/-/ready", Text: "Readiness"},
+		},
+		ExtraHTML: extra.String(),
+		Profiling: "false",
+	})
+}
+
+// describeDir describes the collector reading dir for the landing page
+func describeDir(dir multiprocessDir, snapshotInterval time.Duration) string {
+	description := dir.path
+	if len(dir.labels) > 0 {
+		var labels []string
+		for _, name := range slices.Sorted(maps.Keys(dir.labels)) {
+			labels = append(labels, fmt.Sprintf("%s=%q", name, dir.labels[name]))
+		}
+		description += " {" + strings.Join(labels, ", ") + "}"
+	}
+	if snapshotInterval > 0 {
+		return description + fmt.Sprintf(", read every %s", snapshotInterval)
+	}
+	return description + ", read on every scrape"
+}
+
+// effectiveConfig lists every option in a as its flag and value, leaving out
+// the subcommands
+func effectiveConfig(a args) []configEntry {
+	var config []configEntry
+	v := reflect.ValueOf(a)
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		flag, _, _ := strings.Cut(field.Tag.Get("arg"), ",")
+		if !strings.HasPrefix(flag, "--") {
+			continue
+		}
+		value := v.Field(i).Interface()
+		var text string
+		switch value := value.(type) {
+		case []string:
+			text = strings.Join(value, ",")
+		case map[string]int:
+			var pairs []string
+			for _, name := range slices.Sorted(maps.Keys(value)) {
+				pairs = append(pairs, fmt.Sprintf("%s=%d", name, value[name]))
+			}
+			text = strings.Join(pairs, ",")
+		default:
+			text = fmt.Sprint(value)
+		}
+		config = append(config, configEntry{Flag: flag, Value: text})
+	}
+	return config
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func request(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthyHandler(t *testing.T) {
+	if code, _ := request(t, healthyHandler(), "/-/healthy"); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "promenade")
+	var sampleErr error
+	handler := readyHandler(dirsExist([]multiprocessDir{{path: dir}}), func() error { return sampleErr })
+
+	code, body := request(t, handler, "/-/ready")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, dir) {
+		t.Errorf("expected 503 naming the missing dir, got %d: %s", code, body)
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := request(t, handler, "/-/ready"); code != http.StatusOK {
+		t.Errorf("expected 200 once the dir exists, got %d: %s", code, body)
+	}
+
+	// A glob is ready once it matches a directory
+	glob := readyHandler(dirsExist([]multiprocessDir{{path: filepath.Join(dir, "*")}}))
+	if code, body := request(t, glob, "/-/ready"); code != http.StatusServiceUnavailable || !strings.Contains(body, "matched no directories") {
+		t.Errorf("expected 503 until the glob matches, got %d: %s", code, body)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "web"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := request(t, glob, "/-/ready"); code != http.StatusOK {
+		t.Errorf("expected 200 once the glob matches, got %d: %s", code, body)
+	}
+
+	sampleErr = errors.New("TCP connection sampling is failing: netlink unavailable")
+	code, body = request(t, handler, "/-/ready")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "netlink unavailable") {
+		t.Errorf("expected 503 with the failing check's error, got %d: %s", code, body)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	config := args{
+		Port:               9394,
+		MultiprocessDirs:   []string{"/app/tmp/web:component=web", "/app/tmp/karafka"},
+		FamilySeriesLimits: map[string]int{"http_requests": 100, "jobs": 10},
+		ConflictPolicy:     "newest",
+		SnapshotInterval:   5 * time.Second,
+	}
+	collectors := []collectorInfo{
+		{Name: "tcpconnections", Description: "Peak TCP connections"},
+		{Name: "multiprocess", Description: describeDir(multiprocessDir{path: "/app/tmp/web", labels: prometheus.Labels{"component": "<web>"}}, 5*time.Second)},
+	}
+	handler, err := landingPage(collectors, effectiveConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := request(t, handler, "/")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for _, expected := range []string{
+		`href="/metrics"`,
+		`href="/-/ready"`,
+		"<b>tcpconnections</b>: Peak TCP connections",
+		"<b>multiprocess</b>: /app/tmp/web {component=&#34;&lt;web&gt;&#34;}, read every 5s",
+		"<code>--metrics-port</code></td><td><code>9394</code>",
+		"<code>--multiprocess-dir</code></td><td><code>/app/tmp/web:component=web,/app/tmp/karafka</code>",
+		"<code>--family-series-limit</code></td><td><code>http_requests=100,jobs=10</code>",
+		"<code>--snapshot-interval</code></td><td><code>5s</code>",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the landing page to contain %s:\n%s", expected, body)
+		}
+	}
+
+	if code, _ := request(t, handler, "/missing"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for other paths, got %d", code)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	var flags []string
+	for _, entry := range effectiveConfig(args{Inspect: &inspectCmd{}}) {
+		flags = append(flags, entry.Flag)
+	}
+	if slices.Contains(flags, "inspect") || slices.ContainsFunc(flags, func(flag string) bool { return !strings.HasPrefix(flag, "--") }) {
+		t.Errorf("expected only flags, got %v", flags)
+	}
+	if !slices.Contains(flags, "--web-config-file") {
+		t.Errorf("expected every flag, got %v", flags)
+	}
+}
@@ -4,6 +4,7 @@
 package tcpconnections
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -57,7 +58,9 @@ type Collector struct {
 	window    time.Duration
 	mu        sync.Mutex
 	buckets   []map[string]connectionCounts
-	head      int // index of the current (most recent) bucket
+	head      int   // index of the current (most recent) bucket
+	sampled   bool  // whether any sample has succeeded
+	sampleErr error // error from the latest sample, if it failed
 	done      chan struct{}
 	wg        sync.WaitGroup
 	closeOnce sync.Once
@@ -146,11 +149,13 @@ func nextBackoff(current time.Duration) time.Duration {
 // sample polls netlink and advances the current bucket high-water marks.
 func (c *Collector) sample() error {
 	metrics, err := c.collectMetrics()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampleErr = err
 	if err != nil {
 		return err
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.sampled = true
 	current := c.buckets[c.head]
 	for key, m := range metrics {
 		hwm := current[key]
@@ -165,6 +170,21 @@ func (c *Collector) sample() error {
 	return nil
 }
 
+// Ready returns an error until netlink has been sampled successfully, and
+// while sampling is failing and backing off, when the peaks being served may
+// be stale.
+func (c *Collector) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sampleErr != nil {
+		return fmt.Errorf("TCP connection sampling is failing: %w", c.sampleErr)
+	}
+	if !c.sampled {
+		return errors.New("TCP connections have not been sampled yet")
+	}
+	return nil
+}
+
 // rotate advances the ring: the next slot is cleared and becomes the new current.
 func (c *Collector) rotate() {
 	c.mu.Lock()
@@ -24,5 +24,8 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {}
 // Collect implements prometheus.Collector.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {}
 
+// Ready always returns nil, as there is nothing to sample.
+func (c *Collector) Ready() error { return nil }
+
 // Close implements io.Closer.
 func (c *Collector) Close() error { return nil }
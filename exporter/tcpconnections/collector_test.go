@@ -418,6 +418,42 @@ tcp_queued_connections_peak{listener="0.0.0.0:3000",window="3s"} 0
 	})
 }
 
+func TestCollector_Ready(t *testing.T) {
+	listener := []diag.NetObject{makeNetObject("0.0.0.0", 3000, unix.BPF_TCP_LISTEN, 0)}
+	mock := &mockNetlinkDumper{listenObjects: listener, dumpError: fmt.Errorf("netlink unavailable")}
+	c := newTestCollector(mock)
+	if err := c.Ready(); err == nil {
+		t.Fatal("expected not ready before the first sample")
+	}
+
+	if err := c.sample(); err == nil {
+		t.Fatal("expected error from sample(), got nil")
+	}
+	if err := c.Ready(); err == nil || !strings.Contains(err.Error(), "netlink unavailable") {
+		t.Fatalf("expected not ready with the sampling error, got %v", err)
+	}
+
+	mock.dumpError = nil
+	requireSample(t, c)
+	if err := c.Ready(); err != nil {
+		t.Fatalf("expected ready after a successful sample, got %v", err)
+	}
+
+	// Backing off after a failure makes it unready again, until it recovers
+	mock.dumpError = fmt.Errorf("netlink unavailable")
+	if err := c.sample(); err == nil {
+		t.Fatal("expected error from sample(), got nil")
+	}
+	if err := c.Ready(); err == nil {
+		t.Fatal("expected not ready while sampling is failing")
+	}
+	mock.dumpError = nil
+	requireSample(t, c)
+	if err := c.Ready(); err != nil {
+		t.Errorf("expected ready after recovering, got %v", err)
+	}
+}
+
 func TestNextBackoff(t *testing.T) {
 	tests := []struct {
 		current  time.Duration
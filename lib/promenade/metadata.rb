@@ -0,0 +1,48 @@
+require "json"
+
+module Promenade
+  # Records the help text, type and unit of each metric family in a sidecar
+  # file in the multiprocess directory, so the exporter can serve them instead
+  # of a generic HELP line.
+  module Metadata
+    FILENAME = "promenade_metadata.json".freeze
+
+    module_function
+
+    def record(name, type, options)
+      return unless enabled?
+
+      path = File.join(::Prometheus::Client.configuration.multiprocess_files_dir.to_s, FILENAME)
+      entry = options.metadata(type)
+
+      # Every process defines its metrics on boot, so serialise the
+      # read-modify-write and replace the file atomically for the exporter.
+      File.open("#{path}.lock", File::RDWR | File::CREAT, 0o644) do |lock|
+        lock.flock(File::LOCK_EX)
+
+        metadata = read(path)
+        next if metadata[name.to_s] == entry
+
+        metadata[name.to_s] = entry
+        tmp = "#{path}.#{Process.pid}.tmp"
+        File.write(tmp, JSON.generate(metadata))
+        File.rename(tmp, path)
+      end
+    rescue SystemCallError
+      # Metadata is best effort, it must never stop a metric being defined
+      nil
+    end
+
+    def read(path)
+      JSON.parse(File.read(path))
+    rescue Errno::ENOENT, JSON::ParserError
+      {}
+    end
+
+    def enabled?
+      defined?(::Prometheus::Client::MmapedValue) &&
+        ::Prometheus::Client.configuration.value_class == ::Prometheus::Client::MmapedValue &&
+        File.directory?(::Prometheus::Client.configuration.multiprocess_files_dir.to_s)
+    end
+  end
+end
@@ -1,6 +1,7 @@
 require "promenade"
 require "active_support/concern"
 require "prometheus/client"
+require "promenade/metadata"
 
 module Promenade
   module Prometheus
@@ -22,7 +23,9 @@ module Promenade
 
         options = Options.new
         options.evaluate(&block)
-        registry.method(type).call(name, *options.args(type))
+        registry.method(type).call(name, *options.args(type)).tap do
+          Metadata.record(name, type, options)
+        end
       end
     end
 
@@ -42,6 +45,7 @@ module Promenade
         @buckets = BUCKET_PRESETS[:network]
         @base_labels = {}
         @doc = nil
+        @unit = nil
         @multiprocess_mode = :all
       end
 
@@ -49,6 +53,10 @@ module Promenade
         @doc = str
       end
 
+      def unit(str)
+        @unit = str.to_s
+      end
+
       def base_labels(labels)
         @base_labels = labels
       end
@@ -79,6 +87,10 @@ module Promenade
         end
       end
 
+      def metadata(type)
+        { "type" => type.to_s, "help" => @doc, "unit" => @unit }.compact
+      end
+
       def evaluate(&)
         instance_eval(&)
         self
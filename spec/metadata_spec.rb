@@ -0,0 +1,57 @@
+require "tmpdir"
+
+RSpec.describe Promenade::Metadata do
+  let(:dir) { Pathname.new(Dir.mktmpdir) }
+  let(:path) { dir.join(described_class::FILENAME) }
+
+  after do
+    FileUtils.rm_rf dir
+  end
+
+  context "when multiprocess metrics are enabled" do
+    before do
+      allow(Prometheus::Client.configuration).to receive(:value_class).and_return(Prometheus::Client::MmapedValue)
+      allow(Prometheus::Client.configuration).to receive(:multiprocess_files_dir).and_return(dir)
+    end
+
+    it "records the help, type and unit of defined metrics" do
+      Promenade.counter :promenade_testing_metadata_counter do
+        doc "Counts the tests"
+      end
+
+      Promenade.histogram :promenade_testing_metadata_seconds do
+        doc "Times the tests"
+        unit :seconds
+      end
+
+      expect(JSON.parse(File.read(path))).to eq(
+        "promenade_testing_metadata_counter" => { "type" => "counter", "help" => "Counts the tests" },
+        "promenade_testing_metadata_seconds" => { "type" => "histogram", "help" => "Times the tests", "unit" => "seconds" },
+      )
+    end
+
+    it "keeps metadata recorded by other processes" do
+      File.write(path, JSON.generate("other_metric" => { "type" => "gauge", "help" => "From another process" }))
+
+      Promenade.gauge :promenade_testing_metadata_gauge do
+        doc "A gauge"
+      end
+
+      expect(JSON.parse(File.read(path)).keys).to contain_exactly("other_metric", "promenade_testing_metadata_gauge")
+    end
+  end
+
+  context "when multiprocess metrics are not enabled" do
+    before do
+      allow(Prometheus::Client.configuration).to receive(:multiprocess_files_dir).and_return(dir)
+    end
+
+    it "does not write a metadata file" do
+      Promenade.counter :promenade_testing_metadata_counter do
+        doc "Counts the tests"
+      end
+
+      expect(File).not_to exist(path)
+    end
+  end
+end
@@ -32,6 +32,17 @@ RSpec.describe Promenade::Prometheus::Options do
     end
   end
 
+  context "metadata" do
+    it "includes the type and help" do
+      expect(subject.metadata(:counter)).to eq("type" => "counter", "help" => "Awesome level")
+    end
+
+    it "includes the unit when set" do
+      subject.unit :seconds
+      expect(subject.metadata(:histogram)).to eq("type" => "histogram", "help" => "Awesome level", "unit" => "seconds")
+    end
+  end
+
   context "unknown metric type" do
     it "throws an error" do
       expect { subject.args(:steam_gauge) }.to raise_error "Unsupported metric type: steam_gauge"